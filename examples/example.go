@@ -3,6 +3,7 @@ package main
 import (
     "os"
     "fmt"
+    "strings"
     "github.com/swordqiu/structarg.go/structarg"
 )
 
@@ -13,7 +14,11 @@ type Options struct {
     Timeout int `default:"600" help:"Maximal number of seconds to wait for a response"`
     AuthURLStr string `default:"$AUTH_URL" help:"Authentication URL, default to env[AUTH_URL]"`
     EndpointType string `default:"publicURL" help:"Default to env[ENPOINT_TYPE] or publicURL" choices:"publicURL|internalURL"`
-    Config string `help:"Configuration file path"`
+    Config string `help:"Configuration file path, loaded before the other arguments" config:"true"`
+    EnvFile string `help:"File of environment variables, loaded if it exists" env-file:"true" default:".env"`
+    Profile string `help:"Configuration profile, default to env[STRUCTARGTEST_PROFILE]" profile:"true" default:"$STRUCTARGTEST_PROFILE"`
+    Password string `help:"Password, or @path of a file of the password" secret:"true"`
+    ShowConfig bool `help:"Show the effective configuration and the source of each value"`
     SUBCOMMAND string `help:"climc subcommand" subcommand:"true"`
 }
 
@@ -38,6 +43,11 @@ func main() {
                                             "structargtest",
                                             `Command-line interface test prog`,
                                             `See "structargtest help COMMAND" for help on a subcommand.`)
+    if e != nil {
+        showErrorAndExit(e)
+    }
+    parser.SetEnvPrefix("STRUCTARGTEST_")
+    parser.SetConfigSearchPath(structarg.DefaultConfigSearchPath("structargtest")...)
     subcmd := parser.GetSubcommand()
     if subcmd == nil {
         showErrorAndExit(fmt.Errorf("No subcommand argument"))
@@ -58,15 +68,11 @@ func main() {
     })
     e = parser.ParseArgs(os.Args[1:], false)
     options := parser.Options().(*Options)
-    if len(options.Config) > 0 {
-        ec := parser.ParseFile(options.Config)
-        if ec != nil {
-            fmt.Printf("Error reading config file: %s\n", ec)
-            os.Exit(1)
-        }
-    }
     if options.Help {
         fmt.Print(parser.HelpString())
+    } else if options.ShowConfig {
+        fmt.Printf("Loaded configuration files: %s\n", strings.Join(parser.LoadedConfigFiles(), ", "))
+        fmt.Print(parser.ConfigString())
     } else {
         fmt.Printf("################## Options #################\n")
         fmt.Printf("AuthURLStr = %s\n", options.AuthURLStr)
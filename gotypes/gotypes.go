@@ -4,6 +4,7 @@ import (
     "fmt"
     "reflect"
     "strconv"
+    "time"
 )
 
 
@@ -26,6 +27,7 @@ var (
     float32Value float32
     float64Value float64
     stringValue string
+    durationValue time.Duration
     boolSliceValue  []bool
     intSliceValue   []int
     int8SliceValue  []int8
@@ -40,6 +42,7 @@ var (
     float32SliceValue []float32
     float64SliceValue []float64
     stringSliceValue  []string
+    durationSliceValue []time.Duration
 )
 
 
@@ -58,6 +61,7 @@ var (
     Float32Type = reflect.TypeOf(float32Value)
     Float64Type = reflect.TypeOf(float64Value)
     StringType  = reflect.TypeOf(stringValue)
+    DurationType = reflect.TypeOf(durationValue)
     BoolSliceType = reflect.TypeOf(boolSliceValue)
     IntSliceType  = reflect.TypeOf(intSliceValue)
     Int8SliceType = reflect.TypeOf(int8SliceValue)
@@ -72,6 +76,7 @@ var (
     Float32SliceType = reflect.TypeOf(float32SliceValue)
     Float64SliceType = reflect.TypeOf(float64SliceValue)
     StringSliceType = reflect.TypeOf(stringSliceValue)
+    DurationSliceType = reflect.TypeOf(durationSliceValue)
 )
 
 
@@ -117,7 +122,27 @@ func ParseValue(val string, tp reflect.Type) (reflect.Value, error) {
             }
         case StringType:
             return reflect.ValueOf(val), nil
+        case DurationType:
+            val_duration, err := time.ParseDuration(val)
+            return reflect.ValueOf(val_duration), err
         default:
+            if tp.Kind() == reflect.Ptr {
+                val_elem, err := ParseValue(val, tp.Elem())
+                if err != nil {
+                    return reflect.ValueOf(val), err
+                }
+                val_ptr := reflect.New(tp.Elem())
+                val_ptr.Elem().Set(val_elem)
+                return val_ptr, nil
+            }
+            base_tp := SliceBaseType(tp)
+            if base_tp != nil {
+                val_base, err := ParseValue(val, base_tp)
+                if err != nil {
+                    return reflect.ValueOf(val), err
+                }
+                return reflect.Append(reflect.MakeSlice(tp, 0, 1), val_base), nil
+            }
             return reflect.ValueOf(val), fmt.Errorf("Cannot parse %s to %s", val, tp)
     }
 }
@@ -125,7 +150,17 @@ func ParseValue(val string, tp reflect.Type) (reflect.Value, error) {
 
 func SetValue(value reflect.Value, val string) error {
     if ! value.CanSet() {
-        fmt.Errorf("Value is not settable")
+        return fmt.Errorf("Value is not settable")
+    }
+    if value.Kind() == reflect.Ptr {
+        // allocate a new value, the pointer is set only if the value is valid
+        elem := reflect.New(value.Type().Elem())
+        e := SetValue(elem.Elem(), val)
+        if e != nil {
+            return e
+        }
+        value.Set(elem)
+        return nil
     }
     switch value.Type() {
         case BoolType:
@@ -154,8 +189,14 @@ func SetValue(value reflect.Value, val string) error {
             value.SetFloat(val_float)
         case StringType:
             value.SetString(val)
+        case DurationType:
+            val_duration, e := time.ParseDuration(val)
+            if e != nil {
+                return e
+            }
+            value.SetInt(int64(val_duration))
         default:
-            return fmt.Errorf("Unsupported type: %s", value.Type)
+            return fmt.Errorf("Unsupported type: %s", value.Type())
     }
     return nil
 }
@@ -203,6 +244,8 @@ func SliceBaseType(tp reflect.Type) reflect.Type {
             return Float64Type
         case StringSliceType:
             return StringType
+        case DurationSliceType:
+            return DurationType
         default:
             return nil
     }
@@ -221,6 +264,38 @@ func AppendValue(value reflect.Value, val string) error {
     return nil
 }
 
+func SetMapValue(value reflect.Value, key string, val string) error {
+    if value.Kind() != reflect.Map {
+        return fmt.Errorf("Cannot set item of non-map type")
+    }
+    key_raw, e := ParseValue(key, value.Type().Key())
+    if e != nil {
+        return e
+    }
+    val_raw, e := ParseValue(val, value.Type().Elem())
+    if e != nil {
+        return e
+    }
+    if value.IsNil() {
+        value.Set(reflect.MakeMap(value.Type()))
+    }
+    value.SetMapIndex(key_raw, val_raw)
+    return nil
+}
+
+func IsNumericType(tp reflect.Type) bool {
+    switch tp {
+        case IntType, Int8Type, Int16Type, Int32Type, Int64Type:
+            return true
+        case UintType, Uint8Type, Uint16Type, Uint32Type, Uint64Type:
+            return true
+        case Float32Type, Float64Type:
+            return true
+        default:
+            return false
+    }
+}
+
 func InCollection(obj interface{}, array interface{}) bool {
     var arrVal = reflect.ValueOf(array)
     var arrKind = arrVal.Type().Kind()
@@ -3,6 +3,7 @@ package gotypes
 import (
     "testing"
     "reflect"
+    "time"
 )
 
 
@@ -179,7 +180,108 @@ func TestInCollection(t *testing.T) {
     }
     for _, c := range cases {
         if InCollection(c.obj, c.arr) != c.result {
-            t.Errorf("%s in %s != %b", c.obj, c.arr, c.result)
+            t.Errorf("%s in %s != %v", c.obj, c.arr, c.result)
         }
     }
 }
+
+func TestIsNumericType(t *testing.T) {
+    cases := []struct {
+        tp reflect.Type
+        result bool
+    } {
+        {IntType, true},
+        {Uint8Type, true},
+        {Float64Type, true},
+        {StringType, false},
+        {BoolType, false},
+        {IntSliceType, false},
+        {nil, false},
+    }
+    for _, c := range cases {
+        if IsNumericType(c.tp) != c.result {
+            t.Errorf("IsNumericType %s != %v", c.tp, c.result)
+        }
+    }
+}
+
+func TestParseValueSlice(t *testing.T) {
+    get, e := ParseValue("3", IntSliceType)
+    if e != nil {
+        t.Errorf("ParseValue error %s", e)
+    }
+    if !reflect.DeepEqual(get.Interface(), []int{3}) {
+        t.Errorf("ParseValue 3 %s = %v", IntSliceType, get)
+    }
+    _, e = ParseValue("abc", IntSliceType)
+    if e == nil {
+        t.Errorf("ParseValue abc %s should fail", IntSliceType)
+    }
+}
+
+func TestSetMapValue(t *testing.T) {
+    cases := []struct {
+        In map[string]int
+        Key string
+        Val string
+        Out map[string]int
+    } {
+        {nil, "a", "1", map[string]int{"a": 1}},
+        {map[string]int{"a": 1}, "b", "2", map[string]int{"a": 1, "b": 2}},
+        {map[string]int{"a": 1}, "a", "3", map[string]int{"a": 3}},
+    }
+    for _, c := range cases {
+        ref := reflect.ValueOf(&c).Elem()
+        ref1 := ref.Field(0)
+        e := SetMapValue(ref1, c.Key, c.Val)
+        if e != nil {
+            t.Errorf("SetMapValue error %s", e)
+        }
+        if !reflect.DeepEqual(c.In, c.Out) {
+            t.Errorf("SetMapValue fail %v (%s=%s) != %v", c.In, c.Key, c.Val, c.Out)
+        }
+    }
+    var m map[string]int
+    if e := SetMapValue(reflect.ValueOf(&m).Elem(), "a", "b"); e == nil {
+        t.Errorf("SetMapValue a=b should fail")
+    }
+}
+
+func TestSetValuePointer(t *testing.T) {
+    var b *bool
+    ref := reflect.ValueOf(&b).Elem()
+    if e := SetValue(ref, "yes"); e == nil || b != nil {
+        t.Errorf("SetValue yes should fail and leave the pointer nil")
+    }
+    if e := SetValue(ref, "true"); e != nil || b == nil || *b != true {
+        t.Errorf("SetValue true fail %v", b)
+    }
+}
+
+func TestParseValuePointer(t *testing.T) {
+    var ip *int
+    get, e := ParseValue("100", reflect.TypeOf(ip))
+    if e != nil {
+        t.Errorf("ParseValue error %s", e)
+    }
+    if get.Type() != reflect.TypeOf(ip) || get.Elem().Interface() != 100 {
+        t.Errorf("ParseValue 100 %s = %v", reflect.TypeOf(ip), get)
+    }
+}
+
+func TestDuration(t *testing.T) {
+    get, e := ParseValue("1m30s", DurationType)
+    if e != nil || get.Interface() != 90 * time.Second {
+        t.Errorf("ParseValue 1m30s = %v, %v", get, e)
+    }
+    var d *time.Duration
+    e = SetValue(reflect.ValueOf(&d).Elem(), "2h")
+    if e != nil || d == nil || *d != 2 * time.Hour {
+        t.Errorf("SetValue 2h = %v, %v", d, e)
+    }
+    var ds []time.Duration
+    e = AppendValue(reflect.ValueOf(&ds).Elem(), "5s")
+    if e != nil || len(ds) != 1 || ds[0] != 5 * time.Second {
+        t.Errorf("AppendValue 5s = %v, %v", ds, e)
+    }
+}
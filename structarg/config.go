@@ -0,0 +1,573 @@
+package structarg
+
+import (
+    "os"
+    "io"
+    "bufio"
+    "fmt"
+    "strings"
+    "strconv"
+    "path/filepath"
+)
+
+const (
+    /*
+    the profile used if no profile is selected
+    */
+    DEFAULT_PROFILE = "default"
+    /*
+    the key of a profile section that names the inherited profile
+    */
+    PROFILE_INHERITS = "inherits"
+)
+
+/*
+A key = value entry of a configuration file. Section is the name of the
+[section] the entry belongs to, empty for an entry before any section,
+the parts of a dotted section name are subcommands or prefixes of
+nested structs. Line is 0 if unknown. The value of a literal entry, e.g.
+a single-quoted value, is not expanded.
+*/
+type ConfigEntry struct {
+    Section string
+    Key string
+    Value string
+    Line int
+    Literal bool
+}
+
+/*
+an error in a configuration file, with the file name and line number
+*/
+func configError(filename string, line int, format string, args ...interface{}) error {
+    return fmt.Errorf("%s:%d: %s", filename, line, fmt.Sprintf(format, args...))
+}
+
+func isConfigComment(str string) bool {
+    return strings.HasPrefix(str, "#") || strings.HasPrefix(str, ";")
+}
+
+/*
+whether a line is continued by a trailing backslash, an escaped
+backslash does not continue the line
+*/
+func isContinuedLine(line string) bool {
+    count := 0
+    for i := len(line) - 1; i >= 0 && line[i] == '\\'; i -- {
+        count ++
+    }
+    return count % 2 == 1
+}
+
+/*
+parse a quoted value, returns the value and the rest of the string after
+the closing quote. Escapes are \n, \t, \r, \\ and the quote itself in a
+double-quoted value, only \\ and \' in a single-quoted value.
+*/
+func parseQuotedValue(str string) (string, string, error) {
+    quote := str[0]
+    var buf strings.Builder
+    for i := 1; i < len(str); i ++ {
+        c := str[i]
+        if c == quote {
+            return buf.String(), str[i+1:], nil
+        }
+        if c == '\\' && i + 1 < len(str) {
+            i ++
+            c = str[i]
+            switch {
+                case c == quote || c == '\\':
+                    buf.WriteByte(c)
+                case quote == '\'':
+                    buf.WriteByte('\\')
+                    buf.WriteByte(c)
+                case c == 'n':
+                    buf.WriteByte('\n')
+                case c == 't':
+                    buf.WriteByte('\t')
+                case c == 'r':
+                    buf.WriteByte('\r')
+                default:
+                    return "", "", fmt.Errorf("Invalid escape \\%c", c)
+            }
+            continue
+        }
+        buf.WriteByte(c)
+    }
+    return "", "", fmt.Errorf("Unterminated quoted value")
+}
+
+/*
+parse the value of an entry, a quoted value may be followed only by a
+comment, an unquoted value ends at a comment preceded by a space.
+Returns whether the value is single-quoted, i.e. literal.
+*/
+func parseConfigValue(str string) (string, bool, error) {
+    str = strings.TrimSpace(str)
+    if len(str) == 0 {
+        return str, false, nil
+    }
+    if str[0] == '"' || str[0] == '\'' {
+        value, rest, e := parseQuotedValue(str)
+        if e != nil {
+            return "", false, e
+        }
+        rest = strings.TrimSpace(rest)
+        if len(rest) > 0 && ! isConfigComment(rest) {
+            return "", false, fmt.Errorf("Unexpected %q after quoted value", rest)
+        }
+        return value, str[0] == '\'', nil
+    }
+    for i := 1; i < len(str); i ++ {
+        if (str[i] == '#' || str[i] == ';') && (str[i-1] == ' ' || str[i-1] == '\t') {
+            return strings.TrimSpace(str[:i]), false, nil
+        }
+    }
+    return str, false, nil
+}
+
+/*
+parse a [section] header, which may be followed by a comment
+*/
+func parseConfigSection(line string) (string, error) {
+    pos := strings.IndexByte(line, ']')
+    if pos < 0 {
+        return "", fmt.Errorf("Misformated section: %s", line)
+    }
+    rest := strings.TrimSpace(line[pos+1:])
+    if len(rest) > 0 && ! isConfigComment(rest) {
+        return "", fmt.Errorf("Misformated section: %s", line)
+    }
+    section := strings.TrimSpace(line[1:pos])
+    if len(section) == 0 {
+        return "", fmt.Errorf("Empty section name")
+    }
+    return section, nil
+}
+
+/*
+read the entries of a configuration file. Blank lines and lines starting
+with # or ; are ignored, a trailing backslash continues a line. A
+[section] header starts a section that lasts until the next header.
+*/
+func parseConfigEntries(filename string, reader io.Reader) ([]ConfigEntry, error) {
+    entries := make([]ConfigEntry, 0)
+    scanner := bufio.NewScanner(reader)
+    lineno := 0
+    section := ""
+    for scanner.Scan() {
+        lineno += 1
+        start := lineno
+        line := strings.TrimSpace(scanner.Text())
+        for isContinuedLine(line) {
+            line = line[:len(line)-1]
+            if ! scanner.Scan() {
+                break
+            }
+            lineno += 1
+            line += strings.TrimSpace(scanner.Text())
+        }
+        if len(line) == 0 || isConfigComment(line) {
+            continue
+        }
+        if line[0] == '[' {
+            var e error
+            section, e = parseConfigSection(line)
+            if e != nil {
+                return nil, configError(filename, start, "%s", e)
+            }
+            continue
+        }
+        pos := strings.IndexByte(line, '=')
+        if pos <= 0 {
+            return nil, configError(filename, start, "Misformated line: %s", line)
+        }
+        key := strings.TrimSpace(line[:pos])
+        if len(key) == 0 {
+            return nil, configError(filename, start, "Misformated line: %s", line)
+        }
+        value, literal, e := parseConfigValue(line[pos+1:])
+        if e != nil {
+            return nil, configError(filename, start, "%s", e)
+        }
+        entries = append(entries, ConfigEntry{Section: section, Key: key, Value: value, Line: start, Literal: literal})
+    }
+    if e := scanner.Err(); e != nil {
+        return nil, e
+    }
+    return entries, nil
+}
+
+/*
+split a [profile name] section into the empty section and the profile
+name, a [profile name.cmd] section into the section cmd and the profile
+name, other sections have no profile
+*/
+func splitProfileSection(section string) (string, string) {
+    if strings.HasPrefix(section, "profile ") {
+        name := strings.TrimSpace(section[len("profile "):])
+        pos := strings.IndexByte(name, '.')
+        if pos >= 0 {
+            return name[pos+1:], name[:pos]
+        }
+        return "", name
+    }
+    return section, ""
+}
+
+/*
+whether the entries define a profile, by its keys or its inherits key
+*/
+func hasProfile(entries []ConfigEntry, profile string) bool {
+    for _, entry := range entries {
+        _, name := splitProfileSection(entry.Section)
+        if name == profile {
+            return true
+        }
+    }
+    return false
+}
+
+/*
+select the entries of a profile. The entries outside profile sections
+come first, followed by the entries of the profile and the profiles it
+inherits, in the order of inheritance so that a profile overrides the
+profiles it inherits. A profile that is not given explicitly may be
+missing.
+*/
+func selectProfileEntries(filename string, entries []ConfigEntry, profile string, explicit bool) ([]ConfigEntry, error) {
+    selected := make([]ConfigEntry, 0)
+    profiles := make(map[string][]ConfigEntry)
+    parents := make(map[string]ConfigEntry)
+    for _, entry := range entries {
+        _, name := splitProfileSection(entry.Section)
+        if len(name) == 0 {
+            selected = append(selected, entry)
+        }else if entry.Key == PROFILE_INHERITS {
+            parents[name] = entry
+        }else {
+            profiles[name] = append(profiles[name], entry)
+        }
+    }
+    chain := make([]string, 0)
+    for name := profile; len(name) > 0; {
+        _, has_entries := profiles[name]
+        parent, has_parent := parents[name]
+        if ! has_entries && ! has_parent {
+            if len(chain) == 0 && ! explicit {
+                break
+            }
+            return nil, fmt.Errorf("%s: Unknown profile %s", filename, name)
+        }
+        for _, n := range chain {
+            if n == name {
+                return nil, configError(filename, parents[chain[len(chain)-1]].Line, "Profile inheritance cycle %s -> %s", strings.Join(chain, " -> "), name)
+            }
+        }
+        chain = append(chain, name)
+        name = parent.Value
+    }
+    for i := len(chain) - 1; i >= 0; i -- {
+        selected = append(selected, profiles[chain[i]]...)
+    }
+    return selected, nil
+}
+
+/*
+the configuration files of a program in the order of precedence:
+/etc/prog/config, $XDG_CONFIG_HOME/prog/config with the default
+~/.config, and ./.progrc
+*/
+func DefaultConfigSearchPath(prog string) []string {
+    return []string{
+        fmt.Sprintf("/etc/%s/config", prog),
+        fmt.Sprintf("${XDG_CONFIG_HOME:-~/.config}/%s/config", prog),
+        fmt.Sprintf("./.%src", prog),
+    }
+}
+
+/*
+set the locations of configuration files, e.g. DefaultConfigSearchPath.
+Each existing file is parsed before the arguments in order, a later file
+overrides the values of an earlier file, and the file of the config
+argument overrides them all. A file is parsed once even if it is found
+at several locations. The locations are expanded like defaults.
+*/
+func (this *ArgumentParser) SetConfigSearchPath(paths ...string) {
+    this.configPaths = paths
+}
+
+/*
+the configuration files parsed by the last ParseArgs, in the order of
+parsing, e.g. for debugging the search path
+*/
+func (this *ArgumentParser) LoadedConfigFiles() []string {
+    return this.loadedFiles
+}
+
+/*
+load the existing files of the config search path, then the
+configuration file given by the config argument, before the command-line
+arguments are applied, so that the command line takes precedence. The
+default configuration file is loaded if it exists. A file is loaded only
+once. The profile given on the command line is selected before loading,
+an explicit profile must be defined by one of the files.
+*/
+func (this *ArgumentParser) loadConfigFile(args []string) error {
+    this.loadedFiles = nil
+    if this.profileArg != nil {
+        profile, found := this.scanArgument(args, this.profileArg)
+        if found {
+            e := this.setArgumentValue(this.profileArg, profile, ArgumentSource{Kind: SOURCE_CLI})
+            if e != nil {
+                return e
+            }
+        }
+    }
+    paths := make([]string, 0)
+    for _, path := range this.configPaths {
+        expanded, e := expandString(path, this.lookupEnv)
+        if e != nil {
+            return fmt.Errorf("Cannot expand config path %s: %s", path, e)
+        }
+        if info, e := os.Stat(expanded); e != nil || info.IsDir() {
+            continue
+        }
+        paths = append(paths, expanded)
+    }
+    path, e := this.builtinFilePath(this.configArg, args)
+    if e != nil {
+        return e
+    }
+    if len(path) > 0 {
+        paths = append(paths, path)
+    }
+    loaded := make(map[string]bool)
+    files := make([]string, 0, len(paths))
+    for _, path := range paths {
+        abspath, e := filepath.Abs(path)
+        if e != nil {
+            abspath = filepath.Clean(path)
+        }
+        if ! loaded[abspath] {
+            loaded[abspath] = true
+            files = append(files, path)
+        }
+    }
+    // values of a previous parse of the files, e.g. slices, are parsed again
+    this.resetFileSources(files)
+    has_profile := false
+    for _, path := range files {
+        found, e := this.parseFileFormat(path, "", true)
+        if e != nil {
+            return e
+        }
+        has_profile = has_profile || found
+    }
+    if len(this.loadedFiles) == 0 {
+        return nil
+    }
+    profile, explicit, e := this.selectedProfile()
+    if e != nil {
+        return e
+    }
+    if explicit && ! has_profile {
+        return fmt.Errorf("%s: Unknown profile %s", strings.Join(this.loadedFiles, ", "), profile)
+    }
+    return nil
+}
+
+/*
+reset the arguments of the parser and the parsers of subcommands whose
+values come from one of the files
+*/
+func (this *ArgumentParser) resetFileSources(files []string) {
+    args := make([]Argument, 0, len(this.posArgs) + len(this.optArgs))
+    args = append(args, this.posArgs...)
+    for _, arg := range append(args, this.optArgs...) {
+        src := arg.Source()
+        if src.Kind != SOURCE_FILE {
+            continue
+        }
+        for _, file := range files {
+            if src.File == file {
+                resetArgument(arg)
+                break
+            }
+        }
+    }
+    subcmd := this.GetSubcommand()
+    if subcmd != nil {
+        for _, data := range subcmd.subcommands {
+            data.parser.resetFileSources(files)
+        }
+    }
+}
+
+/*
+find the optional argument of a configuration key and whether the key is
+negated. Only exact long tokens and their no- forms match, a key is
+never abbreviated nor a short token.
+*/
+func (this *ArgumentParser) findConfigArgument(key string) (Argument, bool) {
+    for _, n := range this.optionalNames() {
+        if n.name == key {
+            return n.arg, n.negated
+        }
+    }
+    return nil, false
+}
+
+func (this *ArgumentParser) parseKeyValue(key, value string, src ArgumentSource) error {
+    arg, negated := this.findConfigArgument(key)
+    if arg != nil {
+        if negated {
+            val_bool, e := strconv.ParseBool(value)
+            if e != nil && arg.IsSecret() {
+                return fmt.Errorf("Invalid secret value of %s", arg.Token())
+            }else if e != nil {
+                return e
+            }
+            value = strconv.FormatBool(!val_bool)
+        }
+        return this.setArgumentValue(arg, value, src)
+    }
+    names := make([]string, 0)
+    for _, n := range this.optionalNames() {
+        names = append(names, n.name)
+    }
+    return this.unknownKey(fmt.Errorf("Unknown config key %s%s", key, didYouMean(key, names, "")))
+}
+
+/*
+parse a configuration file of key = value lines, a value may be quoted
+and followed by a comment, see parseConfigEntries for the syntax. The
+entries of a [section] are parsed by the sub-parser of the subcommand.
+The entries of the selected [profile name] section and the profiles it
+inherits are overlaid onto the entries outside profiles.
+*/
+func (this *ArgumentParser) ParseFile(filepath string) error {
+    return this.ParseFileFormat(filepath, "")
+}
+
+/*
+parse a configuration file of a format, e.g. "json", "yaml" or "toml",
+see RegisterConfigDecoder. The format of an empty format is decided by
+the extension of the file.
+*/
+func (this *ArgumentParser) ParseFileFormat(filepath string, format string) error {
+    _, e := this.parseFileFormat(filepath, format, false)
+    return e
+}
+
+/*
+parse a configuration file and return whether it defines the selected
+profile. A layer of the config search path may miss an explicit profile
+defined by another layer.
+*/
+func (this *ArgumentParser) parseFileFormat(filepath string, format string, layer bool) (bool, error) {
+    decoder, e := findConfigDecoder(filepath, format)
+    if e != nil {
+        return false, e
+    }
+    file, e := os.Open(filepath)
+    if e != nil {
+        return false, e
+    }
+    defer file.Close()
+
+    entries, e := decoder(filepath, file)
+    if e != nil {
+        return false, e
+    }
+    profile, explicit, e := this.selectedProfile()
+    if e != nil {
+        return false, e
+    }
+    has_profile := hasProfile(entries, profile)
+    entries, e = selectProfileEntries(filepath, entries, profile, explicit && ! layer)
+    if e != nil {
+        return false, e
+    }
+    for _, entry := range entries {
+        section, profile := splitProfileSection(entry.Section)
+        parser, key, value, e := this.resolveConfigEntry(section, entry.Key, entry.Value)
+        if e == nil && ! entry.Literal {
+            value, e = expandString(value, this.lookupEnv)
+            if e != nil {
+                // the value of a secret is never part of an error
+                if arg, _ := parser.findConfigArgument(key); arg != nil && arg.IsSecret() {
+                    return false, configError(filepath, entry.Line, "Cannot expand %s", entry.Key)
+                }
+                return false, configError(filepath, entry.Line, "Cannot expand %s: %s", entry.Key, e)
+            }
+        }
+        if e == nil {
+            e = parser.parseKeyValue(key, value, ArgumentSource{Kind: SOURCE_FILE, File: filepath, Line: entry.Line, Profile: profile})
+        }else {
+            e = this.unknownKey(e)
+        }
+        if e != nil {
+            return false, configError(filepath, entry.Line, "%s", e)
+        }
+    }
+    this.loadedFiles = append(this.loadedFiles, filepath)
+    return has_profile, nil
+}
+
+/*
+the profile of configuration files, given by the profile argument or its
+default, otherwise the default profile. Returns whether the profile is
+given explicitly, i.e. must exist.
+*/
+func (this *ArgumentParser) selectedProfile() (string, bool, error) {
+    if this.profileArg != nil {
+        if this.profileArg.IsSet() {
+            return this.profileArg.ValueString(), true, nil
+        }
+        e := this.profileArg.resolveDefault()
+        if e != nil {
+            return "", false, e
+        }
+        if this.profileArg.useDefault {
+            return this.profileArg.defValue.String(), true, nil
+        }
+    }
+    return DEFAULT_PROFILE, false, nil
+}
+
+/*
+find the parser, the token and the value of a configuration file entry.
+The parts of a dotted section name subcommands, e.g. [server.create],
+then a map argument whose items are the keys of the section, or the
+prefix of nested struct arguments, e.g. [db] for the key db-host.
+*/
+func (this *ArgumentParser) resolveConfigEntry(section string, key string, value string) (*ArgumentParser, string, string, error) {
+    parser := this
+    parts := make([]string, 0)
+    if len(section) > 0 {
+        parts = strings.Split(section, ".")
+    }
+    for len(parts) > 0 {
+        subcmd := parser.GetSubcommand()
+        if subcmd == nil || subcmd.subParser(strings.TrimSpace(parts[0])) == nil {
+            break
+        }
+        parser = subcmd.subParser(strings.TrimSpace(parts[0]))
+        parts = parts[1:]
+    }
+    token := strings.Replace(key, "_", "-", -1)
+    if len(parts) == 0 {
+        return parser, token, value, nil
+    }
+    prefix := strings.Replace(strings.Join(parts, "-"), "_", "-", -1)
+    if _, ok := parser.findArgument(prefix).(*MapArgument); ok {
+        return parser, prefix, key + "=" + value, nil
+    }
+    for _, arg := range parser.optArgs {
+        if strings.HasPrefix(arg.Token(), prefix + "-") {
+            return parser, prefix + "-" + token, value, nil
+        }
+    }
+    return nil, "", "", fmt.Errorf("Unknown section [%s]", section)
+}
@@ -0,0 +1,267 @@
+package structarg
+
+import (
+    "os"
+    "reflect"
+    "strings"
+    "testing"
+    "path/filepath"
+)
+
+func TestParseConfigEntries(t *testing.T) {
+    content := "# comment\n" +
+            "; another comment\n" +
+            "\n" +
+            "  timeout = 30  \n" +
+            "url = http://host/path#frag # trailing comment\n" +
+            "name = \"a \\\"b\\\"\\tc\" ; comment\n" +
+            "raw = 'C:\\dir\\n'\n" +
+            "long = one \\\n" +
+            "    two\n" +
+            "empty =\n" +
+            "path = /a\\\\\n" +
+            "last = x\n"
+    entries, e := parseConfigEntries("test.conf", strings.NewReader(content))
+    if e != nil {
+        t.Fatalf("parseConfigEntries error %s", e)
+    }
+    expect := []ConfigEntry{
+        {"", "timeout", "30", 4, false},
+        {"", "url", "http://host/path#frag", 5, false},
+        {"", "name", "a \"b\"\tc", 6, false},
+        {"", "raw", "C:\\dir\\n", 7, true},
+        {"", "long", "one two", 8, false},
+        {"", "empty", "", 10, false},
+        {"", "path", "/a\\\\", 11, false},
+        {"", "last", "x", 12, false},
+    }
+    if len(entries) != len(expect) {
+        t.Fatalf("parseConfigEntries = %v", entries)
+    }
+    for i, entry := range entries {
+        if entry != expect[i] {
+            t.Errorf("entry %d = %v, expect %v", i, entry, expect[i])
+        }
+    }
+}
+
+func TestParseConfigEntriesError(t *testing.T) {
+    cases := []struct {
+        content string
+        err string
+    } {
+        {"timeout\n", "test.conf:1: Misformated line"},
+        {"\n = 30\n", "test.conf:2: Misformated line"},
+        {"a = 1\nname = \"abc\n", "test.conf:2: Unterminated"},
+        {"name = \"abc\" def\n", "test.conf:1: Unexpected"},
+        {"name = \"\\x\"\n", "test.conf:1: Invalid escape"},
+        {"[test\n", "test.conf:1: Misformated section"},
+        {"a = 1\n[test] a = 1\n", "test.conf:2: Misformated section"},
+        {"[ ]\n", "test.conf:1: Empty section"},
+    }
+    for _, c := range cases {
+        _, e := parseConfigEntries("test.conf", strings.NewReader(c.content))
+        if e == nil || ! strings.HasPrefix(e.Error(), c.err) {
+            t.Errorf("parseConfigEntries %q error %v, expect %s", c.content, e, c.err)
+        }
+    }
+}
+
+func TestParseConfigSections(t *testing.T) {
+    content := "a = 1\n[test] # comment\nb = 2\n[ server.create ]\nc = 3\n"
+    entries, e := parseConfigEntries("test.conf", strings.NewReader(content))
+    if e != nil {
+        t.Fatalf("parseConfigEntries error %s", e)
+    }
+    expect := []ConfigEntry{
+        {"", "a", "1", 1, false},
+        {"test", "b", "2", 3, false},
+        {"server.create", "c", "3", 5, false},
+    }
+    if len(entries) != len(expect) {
+        t.Fatalf("parseConfigEntries = %v", entries)
+    }
+    for i, entry := range entries {
+        if entry != expect[i] {
+            t.Errorf("entry %d = %v, expect %v", i, entry, expect[i])
+        }
+    }
+}
+
+func TestSelectProfileEntries(t *testing.T) {
+    content := "a = base\n" +
+            "[profile base]\nb = base\n" +
+            "[profile prod]\ninherits = base\na = prod\n" +
+            "[test]\nc = test\n" +
+            "[profile default]\na = default\n"
+    entries, e := parseConfigEntries("test.conf", strings.NewReader(content))
+    if e != nil {
+        t.Fatalf("parseConfigEntries error %s", e)
+    }
+    cases := []struct {
+        profile string
+        explicit bool
+        values []string
+    } {
+        {"prod", true, []string{"a=base", "c=test", "b=base", "a=prod"}},
+        {"base", true, []string{"a=base", "c=test", "b=base"}},
+        {"default", false, []string{"a=base", "c=test", "a=default"}},
+    }
+    for _, c := range cases {
+        selected, e := selectProfileEntries("test.conf", entries, c.profile, c.explicit)
+        if e != nil {
+            t.Errorf("selectProfileEntries %s error %s", c.profile, e)
+            continue
+        }
+        values := make([]string, len(selected))
+        for i, entry := range selected {
+            values[i] = entry.Key + "=" + entry.Value
+        }
+        if strings.Join(values, " ") != strings.Join(c.values, " ") {
+            t.Errorf("selectProfileEntries %s = %v", c.profile, values)
+        }
+    }
+}
+
+func TestSelectProfileEntriesError(t *testing.T) {
+    cases := []struct {
+        content string
+        profile string
+        explicit bool
+        err string
+    } {
+        {"a = 1\n", "prod", true, "test.conf: Unknown profile prod"},
+        {"[profile prod]\ninherits = base\n", "prod", true, "test.conf: Unknown profile base"},
+        {"[profile a]\ninherits = b\n[profile b]\ninherits = a\n", "a", false, "test.conf:4: Profile inheritance cycle a -> b -> a"},
+        {"[profile a]\ninherits = a\n", "a", true, "test.conf:2: Profile inheritance cycle a -> a"},
+    }
+    for _, c := range cases {
+        entries, e := parseConfigEntries("test.conf", strings.NewReader(c.content))
+        if e != nil {
+            t.Fatalf("parseConfigEntries error %s", e)
+        }
+        _, e = selectProfileEntries("test.conf", entries, c.profile, c.explicit)
+        if e == nil || e.Error() != c.err {
+            t.Errorf("selectProfileEntries %q error %v, expect %s", c.content, e, c.err)
+        }
+    }
+    entries, _ := parseConfigEntries("test.conf", strings.NewReader("a = 1\n"))
+    selected, e := selectProfileEntries("test.conf", entries, DEFAULT_PROFILE, false)
+    if e != nil || len(selected) != 1 {
+        t.Errorf("A missing default profile should be ignored: %v %s", selected, e)
+    }
+}
+
+func TestConfigSearchPath(t *testing.T) {
+    dir := t.TempDir()
+    system := filepath.Join(dir, "etc", "test", "config")
+    user := filepath.Join(dir, "home", ".config", "test", "config")
+    for _, path := range []string{system, user} {
+        os.MkdirAll(filepath.Dir(path), 0755)
+    }
+    os.WriteFile(system, []byte("timeout = 30\nregion = east\ntags = a\n"), 0644)
+    os.WriteFile(user, []byte("timeout = 20\n"), 0644)
+    explicit := writeTestFile(t, "explicit.conf", "timeout = 10\n")
+    os.Setenv("STRUCTARG_TEST_CONFIG_HOME", filepath.Join(dir, "home", ".config"))
+    defer os.Unsetenv("STRUCTARG_TEST_CONFIG_HOME")
+    search := []string{system, "${STRUCTARG_TEST_CONFIG_HOME}/test/config", filepath.Join(dir, "missing"), dir}
+    cases := []struct {
+        args []string
+        timeout int
+        source string
+        loaded []string
+    } {
+        {[]string{}, 20, "file " + user, []string{system, user}},
+        {[]string{"--config", explicit}, 10, "file " + explicit, []string{system, user, explicit}},
+        {[]string{"--config", explicit, "--timeout", "5"}, 5, "command line", []string{system, user, explicit}},
+    }
+    for _, c := range cases {
+        options := &configOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        parser.SetConfigSearchPath(search...)
+        e = parser.ParseArgs(c.args, false)
+        if e != nil {
+            t.Errorf("ParseArgs %v error %s", c.args, e)
+            continue
+        }
+        src, _ := parser.Source("timeout")
+        if options.Timeout != c.timeout || options.Region != "east" || ! reflect.DeepEqual(options.Tags, []string{"a"}) || ! strings.HasPrefix(src.String(), c.source) {
+            t.Errorf("ParseArgs %v = %d %q %v (%s)", c.args, options.Timeout, options.Region, options.Tags, src)
+        }
+        if ! reflect.DeepEqual(parser.LoadedConfigFiles(), c.loaded) {
+            t.Errorf("ParseArgs %v loaded %v", c.args, parser.LoadedConfigFiles())
+        }
+    }
+    parser, _ := NewArgumentParser(&configOptions{}, "test", "test prog", "")
+    parser.SetConfigSearchPath("${STRUCTARG_TEST_UNSET:?not set}/config")
+    e := parser.ParseArgs([]string{}, false)
+    if e == nil || ! strings.HasPrefix(e.Error(), "Cannot expand config path") {
+        t.Errorf("Config path expansion error %v", e)
+    }
+}
+
+func TestConfigSearchPathProfile(t *testing.T) {
+    system := writeTestFile(t, "system.conf", "timeout = 30\n[profile prod]\nregion = east\n")
+    user := writeTestFile(t, "user.conf", "timeout = 20\n")
+    cases := []struct {
+        args []string
+        region string
+        err string
+    } {
+        {[]string{"--profile", "prod"}, "east", ""},
+        {[]string{}, "", ""},
+        {[]string{"--profile", "dev"}, "", system + ", " + user + ": Unknown profile dev"},
+    }
+    for _, c := range cases {
+        options := &profileOptions{}
+        parser, _ := NewArgumentParser(options, "test", "test prog", "")
+        parser.SetConfigSearchPath(system, user)
+        e := parser.ParseArgs(c.args, false)
+        if len(c.err) > 0 {
+            if e == nil || e.Error() != c.err {
+                t.Errorf("ParseArgs %v error %v, expect %s", c.args, e, c.err)
+            }
+            continue
+        }
+        if e != nil || options.Timeout != 20 || options.Region != c.region {
+            t.Errorf("ParseArgs %v = %d %q %v", c.args, options.Timeout, options.Region, e)
+        }
+    }
+}
+
+func TestConfigSearchPathOverlap(t *testing.T) {
+    path := writeTestFile(t, "test.conf", "tags = a\ntags = b\n")
+    relpath, e := filepath.Rel(".", path)
+    if e != nil {
+        relpath = path
+    }
+    options := &configOptions{}
+    parser, _ := NewArgumentParser(options, "test", "test prog", "")
+    parser.SetConfigSearchPath(path, filepath.Dir(path) + "/./test.conf")
+    for i := 0; i < 2; i ++ {
+        e = parser.ParseArgs([]string{"--config", relpath}, false)
+        if e != nil {
+            t.Fatalf("ParseArgs error %s", e)
+        }
+        if ! reflect.DeepEqual(options.Tags, []string{"a", "b"}) {
+            t.Errorf("ParseArgs %d tags = %v", i, options.Tags)
+        }
+        if ! reflect.DeepEqual(parser.LoadedConfigFiles(), []string{path}) {
+            t.Errorf("ParseArgs %d loaded %v", i, parser.LoadedConfigFiles())
+        }
+    }
+}
+
+func TestDefaultConfigSearchPath(t *testing.T) {
+    expect := []string{"/etc/climc/config", "${XDG_CONFIG_HOME:-~/.config}/climc/config", "./.climcrc"}
+    if ! reflect.DeepEqual(DefaultConfigSearchPath("climc"), expect) {
+        t.Errorf("DefaultConfigSearchPath = %v", DefaultConfigSearchPath("climc"))
+    }
+    path, e := expandString(DefaultConfigSearchPath("climc")[1], testLookup)
+    if e != nil || path != "/home/test/.config/climc/config" {
+        t.Errorf("expand default search path = %s %v", path, e)
+    }
+}
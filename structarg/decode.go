@@ -0,0 +1,680 @@
+package structarg
+
+import (
+    "io"
+    "io/ioutil"
+    "bytes"
+    "fmt"
+    "strings"
+    "strconv"
+    "path/filepath"
+    "encoding/json"
+)
+
+/*
+A ConfigDecoder reads the entries of a configuration file. A nested
+object is decoded to the entries of a dotted section, an array to
+repeated entries of the same key.
+*/
+type ConfigDecoder func(filename string, reader io.Reader) ([]ConfigEntry, error)
+
+var configDecoders = map[string]ConfigDecoder {
+    "ini": parseConfigEntries,
+    "json": decodeJSONConfig,
+    "yaml": decodeYAMLConfig,
+    "yml": decodeYAMLConfig,
+    "toml": decodeTOMLConfig,
+}
+
+/*
+register the decoder of a configuration file format, the format is also
+the file extension that selects the decoder
+*/
+func RegisterConfigDecoder(format string, decoder ConfigDecoder) {
+    configDecoders[strings.ToLower(format)] = decoder
+}
+
+/*
+find the decoder of a format, an empty format is decided by the extension
+of the file, a file of an unknown extension is a key = value file
+*/
+func findConfigDecoder(filename string, format string) (ConfigDecoder, error) {
+    if len(format) > 0 {
+        decoder, ok := configDecoders[strings.ToLower(format)]
+        if ! ok {
+            return nil, fmt.Errorf("Unknown config format %s", format)
+        }
+        return decoder, nil
+    }
+    ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+    decoder, ok := configDecoders[ext]
+    if ! ok {
+        return parseConfigEntries, nil
+    }
+    return decoder, nil
+}
+
+func joinSection(section string, key string) string {
+    if len(section) == 0 {
+        return key
+    }else if len(key) == 0 {
+        return section
+    }
+    return section + "." + key
+}
+
+/*
+find a separator outside quotes and brackets, returns -1 and the depth of
+the unclosed brackets if not found
+*/
+func indexQuoted(str string, sep byte) (int, int, error) {
+    var quote byte = 0
+    depth := 0
+    for i := 0; i < len(str); i ++ {
+        c := str[i]
+        switch {
+            case quote != 0:
+                if c == '\\' && quote == '"' {
+                    i ++
+                }else if c == quote {
+                    quote = 0
+                }
+            case c == '"' || c == '\'':
+                quote = c
+            case c == '[' || c == '{':
+                depth ++
+            case c == ']' || c == '}':
+                depth --
+            case c == sep && depth == 0:
+                return i, depth, nil
+        }
+    }
+    if quote != 0 {
+        return -1, depth, fmt.Errorf("Unterminated quoted value")
+    }
+    return -1, depth, nil
+}
+
+/*
+split a string by a separator outside quotes and brackets
+*/
+func splitQuoted(str string, sep byte) ([]string, error) {
+    parts := make([]string, 0)
+    for {
+        pos, _, e := indexQuoted(str, sep)
+        if e != nil {
+            return nil, e
+        }
+        if pos < 0 {
+            return append(parts, strings.TrimSpace(str)), nil
+        }
+        parts = append(parts, strings.TrimSpace(str[:pos]))
+        str = str[pos+1:]
+    }
+}
+
+/*
+decoder of JSON configuration files, the top level must be an object.
+A null value is skipped.
+*/
+type jsonConfigDecoder struct {
+    filename string
+    data []byte
+    decoder *json.Decoder
+    entries []ConfigEntry
+}
+
+func decodeJSONConfig(filename string, reader io.Reader) ([]ConfigEntry, error) {
+    data, e := ioutil.ReadAll(reader)
+    if e != nil {
+        return nil, e
+    }
+    this := &jsonConfigDecoder{filename: filename, data: data,
+                    decoder: json.NewDecoder(bytes.NewReader(data)),
+                    entries: make([]ConfigEntry, 0)}
+    this.decoder.UseNumber()
+    tok, e := this.decoder.Token()
+    if e != nil {
+        return nil, this.syntaxError(e)
+    }
+    if tok != json.Delim('{') {
+        return nil, configError(filename, this.line(), "JSON configuration must be an object")
+    }
+    e = this.decodeObject("")
+    if e != nil {
+        return nil, e
+    }
+    if _, e = this.decoder.Token(); e != io.EOF {
+        return nil, configError(filename, this.line(), "Unexpected data after JSON object")
+    }
+    return this.entries, nil
+}
+
+/*
+the line of the current offset of the decoder
+*/
+func (this *jsonConfigDecoder) line() int {
+    offset := int(this.decoder.InputOffset())
+    return bytes.Count(this.data[:offset], []byte("\n")) + 1
+}
+
+func (this *jsonConfigDecoder) syntaxError(e error) error {
+    if se, ok := e.(*json.SyntaxError); ok {
+        line := bytes.Count(this.data[:se.Offset], []byte("\n")) + 1
+        return configError(this.filename, line, "%s", se)
+    }
+    return configError(this.filename, this.line(), "%s", e)
+}
+
+/*
+decode the members of an object after its opening brace
+*/
+func (this *jsonConfigDecoder) decodeObject(section string) error {
+    for this.decoder.More() {
+        tok, e := this.decoder.Token()
+        if e != nil {
+            return this.syntaxError(e)
+        }
+        key := tok.(string)
+        line := this.line()
+        tok, e = this.decoder.Token()
+        if e != nil {
+            return this.syntaxError(e)
+        }
+        switch tok {
+            case json.Delim('{'):
+                e = this.decodeObject(joinSection(section, key))
+            case json.Delim('['):
+                e = this.decodeArray(section, key, line)
+            default:
+                e = this.addEntry(section, key, tok, line)
+        }
+        if e != nil {
+            return e
+        }
+    }
+    _, e := this.decoder.Token()
+    if e != nil {
+        return this.syntaxError(e)
+    }
+    return nil
+}
+
+func (this *jsonConfigDecoder) decodeArray(section string, key string, line int) error {
+    for this.decoder.More() {
+        tok, e := this.decoder.Token()
+        if e != nil {
+            return this.syntaxError(e)
+        }
+        if _, ok := tok.(json.Delim); ok {
+            return configError(this.filename, this.line(), "Unsupported array of arrays or objects for %s", key)
+        }
+        e = this.addEntry(section, key, tok, line)
+        if e != nil {
+            return e
+        }
+    }
+    _, e := this.decoder.Token()
+    if e != nil {
+        return this.syntaxError(e)
+    }
+    return nil
+}
+
+func (this *jsonConfigDecoder) addEntry(section string, key string, tok json.Token, line int) error {
+    var value string
+    switch v := tok.(type) {
+        case nil:
+            return nil
+        case string:
+            value = v
+        case json.Number:
+            value = v.String()
+        case bool:
+            value = strconv.FormatBool(v)
+        default:
+            return configError(this.filename, line, "Unsupported value %v for %s", tok, key)
+    }
+    this.entries = append(this.entries, ConfigEntry{Section: section, Key: key, Value: value, Line: line})
+    return nil
+}
+
+/*
+A line of a YAML file without the comment
+*/
+type yamlLine struct {
+    indent int
+    text string
+    line int
+}
+
+/*
+decoder of a subset of YAML: block mappings, block and flow sequences of
+scalars, plain and quoted scalars and comments. Anchors, tags, block
+scalars and flow mappings are not supported.
+*/
+type yamlConfigDecoder struct {
+    filename string
+    lines []yamlLine
+    pos int
+    entries []ConfigEntry
+}
+
+/*
+strip the comment of a YAML line, a comment starts with # at the start
+of the line or after a space, outside a quoted scalar
+*/
+func stripYAMLComment(text string) string {
+    var quote byte = 0
+    for i := 0; i < len(text); i ++ {
+        c := text[i]
+        if quote != 0 {
+            if c == '\\' && quote == '"' {
+                i ++
+            }else if c == quote {
+                quote = 0
+            }
+            continue
+        }
+        prev := strings.TrimRight(text[:i], " \t")
+        switch {
+            case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+                return strings.TrimRight(text[:i], " \t")
+            case (c == '"' || c == '\'') && (len(prev) == 0 || strings.IndexByte(":-[,", prev[len(prev)-1]) >= 0):
+                quote = c
+        }
+    }
+    return strings.TrimRight(text, " \t")
+}
+
+func decodeYAMLConfig(filename string, reader io.Reader) ([]ConfigEntry, error) {
+    data, e := ioutil.ReadAll(reader)
+    if e != nil {
+        return nil, e
+    }
+    this := &yamlConfigDecoder{filename: filename, entries: make([]ConfigEntry, 0)}
+    for i, raw := range strings.Split(string(data), "\n") {
+        text := strings.TrimLeft(raw, " ")
+        if strings.HasPrefix(text, "\t") {
+            return nil, configError(filename, i + 1, "Tabs are not allowed for indentation")
+        }
+        text = stripYAMLComment(text)
+        if len(text) == 0 || text == "---" || text == "..." {
+            continue
+        }
+        this.lines = append(this.lines, yamlLine{indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text, line: i + 1})
+    }
+    if len(this.lines) > 0 {
+        e = this.decodeMapping(this.lines[0].indent, "")
+        if e != nil {
+            return nil, e
+        }
+    }
+    return this.entries, nil
+}
+
+func isYAMLSequenceItem(text string) bool {
+    return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+/*
+split a "key: value" line, returns false if the line is not a mapping
+*/
+func splitYAMLKey(text string) (string, string, bool) {
+    if len(text) == 0 {
+        return "", "", false
+    }
+    start := 0
+    if text[0] == '"' || text[0] == '\'' {
+        _, rest, e := parseYAMLQuoted(text)
+        if e != nil {
+            return "", "", false
+        }
+        start = len(text) - len(rest)
+    }
+    for i := start; i < len(text); i ++ {
+        if text[i] == ':' && (i + 1 == len(text) || text[i+1] == ' ') {
+            key := strings.TrimSpace(text[:i])
+            if start > 0 {
+                key, _, _ = parseYAMLQuoted(key)
+            }
+            return key, strings.TrimSpace(text[i+1:]), len(key) > 0
+        }
+    }
+    return "", "", false
+}
+
+/*
+parse a quoted YAML scalar, a single-quoted scalar escapes a quote by
+doubling it
+*/
+func parseYAMLQuoted(str string) (string, string, error) {
+    if str[0] == '"' {
+        return parseQuotedValue(str)
+    }
+    var buf strings.Builder
+    for i := 1; i < len(str); i ++ {
+        if str[i] == '\'' {
+            if i + 1 < len(str) && str[i+1] == '\'' {
+                buf.WriteByte('\'')
+                i ++
+                continue
+            }
+            return buf.String(), str[i+1:], nil
+        }
+        buf.WriteByte(str[i])
+    }
+    return "", "", fmt.Errorf("Unterminated quoted value")
+}
+
+/*
+parse a YAML scalar, returns false for a null value
+*/
+func parseYAMLScalar(str string) (string, bool, error) {
+    if len(str) == 0 {
+        return "", false, nil
+    }
+    switch str[0] {
+        case '"', '\'':
+            value, rest, e := parseYAMLQuoted(str)
+            if e != nil {
+                return "", false, e
+            }
+            if len(strings.TrimSpace(rest)) > 0 {
+                return "", false, fmt.Errorf("Unexpected %q after quoted value", rest)
+            }
+            return value, true, nil
+        case '{':
+            return "", false, fmt.Errorf("Unsupported flow mapping")
+        case '|', '>':
+            return "", false, fmt.Errorf("Unsupported block scalar")
+        case '&', '*', '!':
+            return "", false, fmt.Errorf("Unsupported anchor, alias or tag")
+    }
+    switch str {
+        case "~", "null", "Null", "NULL":
+            return "", false, nil
+    }
+    return str, true, nil
+}
+
+func (this *yamlConfigDecoder) addValue(section string, key string, str string, line int) error {
+    value, ok, e := parseYAMLScalar(str)
+    if e != nil {
+        return configError(this.filename, line, "%s", e)
+    }
+    if ok {
+        this.entries = append(this.entries, ConfigEntry{Section: section, Key: key, Value: value, Line: line,
+                                Literal: str[0] == '\''})
+    }
+    return nil
+}
+
+func (this *yamlConfigDecoder) decodeMapping(indent int, section string) error {
+    for this.pos < len(this.lines) {
+        l := this.lines[this.pos]
+        if l.indent < indent {
+            return nil
+        }
+        if l.indent > indent {
+            return configError(this.filename, l.line, "Unexpected indentation")
+        }
+        if isYAMLSequenceItem(l.text) {
+            return configError(this.filename, l.line, "Unexpected sequence item")
+        }
+        key, value, ok := splitYAMLKey(l.text)
+        if ! ok {
+            return configError(this.filename, l.line, "Misformated line: %s", l.text)
+        }
+        this.pos ++
+        var e error
+        if len(value) > 0 {
+            e = this.decodeValue(section, key, value, l.line)
+        }else if this.pos < len(this.lines) {
+            next := this.lines[this.pos]
+            if next.indent >= indent && isYAMLSequenceItem(next.text) {
+                e = this.decodeSequence(next.indent, section, key)
+            }else if next.indent > indent {
+                e = this.decodeMapping(next.indent, joinSection(section, key))
+            }
+        }
+        if e != nil {
+            return e
+        }
+    }
+    return nil
+}
+
+func (this *yamlConfigDecoder) decodeValue(section string, key string, value string, line int) error {
+    if value[0] != '[' {
+        return this.addValue(section, key, value, line)
+    }
+    if value[len(value)-1] != ']' {
+        return configError(this.filename, line, "Unterminated flow sequence")
+    }
+    items, e := splitQuoted(value[1:len(value)-1], ',')
+    if e != nil {
+        return configError(this.filename, line, "%s", e)
+    }
+    for i, item := range items {
+        if len(item) == 0 && i == len(items) - 1 {
+            break
+        }
+        if strings.HasPrefix(item, "[") {
+            return configError(this.filename, line, "Unsupported nested sequence for %s", key)
+        }
+        e = this.addValue(section, key, item, line)
+        if e != nil {
+            return e
+        }
+    }
+    return nil
+}
+
+func (this *yamlConfigDecoder) decodeSequence(indent int, section string, key string) error {
+    for this.pos < len(this.lines) {
+        l := this.lines[this.pos]
+        if l.indent < indent || (l.indent == indent && ! isYAMLSequenceItem(l.text)) {
+            return nil
+        }
+        if l.indent > indent {
+            return configError(this.filename, l.line, "Unexpected indentation")
+        }
+        item := strings.TrimSpace(l.text[1:])
+        if len(item) == 0 {
+            // a null item
+            this.pos ++
+            continue
+        }
+        if _, _, ok := splitYAMLKey(item); ok || isYAMLSequenceItem(item) || strings.HasPrefix(item, "[") {
+            return configError(this.filename, l.line, "Unsupported sequence of mappings or sequences for %s", key)
+        }
+        e := this.addValue(section, key, item, l.line)
+        if e != nil {
+            return e
+        }
+        this.pos ++
+    }
+    return nil
+}
+
+/*
+decoder of a subset of TOML: tables, dotted keys, strings, literal
+strings, bare values such as numbers, booleans and dates, and arrays of
+them, which may span lines. Multi-line strings, inline tables and arrays
+of tables are not supported.
+*/
+func decodeTOMLConfig(filename string, reader io.Reader) ([]ConfigEntry, error) {
+    data, e := ioutil.ReadAll(reader)
+    if e != nil {
+        return nil, e
+    }
+    entries := make([]ConfigEntry, 0)
+    lines := strings.Split(string(data), "\n")
+    table := ""
+    for i := 0; i < len(lines); i ++ {
+        lineno := i + 1
+        line := stripTOMLComment(lines[i])
+        if len(line) == 0 {
+            continue
+        }
+        if strings.HasPrefix(line, "[[") {
+            return nil, configError(filename, lineno, "Unsupported array of tables")
+        }
+        if line[0] == '[' {
+            if line[len(line)-1] != ']' {
+                return nil, configError(filename, lineno, "Misformated table: %s", line)
+            }
+            keys, e := parseTOMLKey(line[1:len(line)-1])
+            if e != nil {
+                return nil, configError(filename, lineno, "%s", e)
+            }
+            table = strings.Join(keys, ".")
+            continue
+        }
+        pos, _, e := indexQuoted(line, '=')
+        if e != nil || pos <= 0 {
+            return nil, configError(filename, lineno, "Misformated line: %s", line)
+        }
+        keys, e := parseTOMLKey(line[:pos])
+        if e != nil {
+            return nil, configError(filename, lineno, "%s", e)
+        }
+        value := strings.TrimSpace(line[pos+1:])
+        // an array may span lines
+        for strings.HasPrefix(value, "[") && ! isTOMLArrayClosed(value) && i + 1 < len(lines) {
+            i ++
+            value += " " + stripTOMLComment(lines[i])
+        }
+        section := joinSection(table, strings.Join(keys[:len(keys)-1], "."))
+        values, e := parseTOMLValue(value)
+        if e != nil {
+            return nil, configError(filename, lineno, "%s", e)
+        }
+        for _, v := range values {
+            v.Section, v.Key, v.Line = section, keys[len(keys)-1], lineno
+            entries = append(entries, v)
+        }
+    }
+    return entries, nil
+}
+
+/*
+strip the comment of a TOML line, a comment starts with # outside a
+string
+*/
+func stripTOMLComment(line string) string {
+    var quote byte = 0
+    for i := 0; i < len(line); i ++ {
+        c := line[i]
+        if quote != 0 {
+            if c == '\\' && quote == '"' {
+                i ++
+            }else if c == quote {
+                quote = 0
+            }
+        }else if c == '"' || c == '\'' {
+            quote = c
+        }else if c == '#' {
+            return strings.TrimSpace(line[:i])
+        }
+    }
+    return strings.TrimSpace(line)
+}
+
+func isTOMLArrayClosed(value string) bool {
+    _, depth, e := indexQuoted(value, 0)
+    return e == nil && depth <= 0
+}
+
+/*
+parse a TOML key, the parts of a dotted key may be quoted
+*/
+func parseTOMLKey(str string) ([]string, error) {
+    parts, e := splitQuoted(str, '.')
+    if e != nil {
+        return nil, e
+    }
+    for i, part := range parts {
+        if len(part) > 0 && (part[0] == '"' || part[0] == '\'') {
+            values, e := parseTOMLValue(part)
+            if e != nil {
+                return nil, e
+            }
+            parts[i] = values[0].Value
+        }else if len(part) == 0 || strings.IndexAny(part, " \t[]{}=") >= 0 {
+            return nil, fmt.Errorf("Invalid key %q", str)
+        }
+    }
+    return parts, nil
+}
+
+/*
+parse a TOML value to entries of the value, an array is parsed to its
+items. A literal string is a literal entry.
+*/
+func parseTOMLValue(str string) ([]ConfigEntry, error) {
+    if len(str) == 0 {
+        return nil, fmt.Errorf("Missing value")
+    }
+    var value, rest string
+    var e error
+    switch {
+        case strings.HasPrefix(str, "\"\"\"") || strings.HasPrefix(str, "'''"):
+            return nil, fmt.Errorf("Unsupported multi-line string")
+        case str[0] == '"':
+            value, rest, e = parseQuotedValue(str)
+        case str[0] == '\'':
+            pos := strings.IndexByte(str[1:], '\'')
+            if pos < 0 {
+                return nil, fmt.Errorf("Unterminated quoted value")
+            }
+            value, rest = str[1:pos+1], str[pos+2:]
+        case str[0] == '{':
+            return nil, fmt.Errorf("Unsupported inline table")
+        case str[0] == '[':
+            if str[len(str)-1] != ']' {
+                return nil, fmt.Errorf("Unterminated array")
+            }
+            items, e := splitQuoted(str[1:len(str)-1], ',')
+            if e != nil {
+                return nil, e
+            }
+            values := make([]ConfigEntry, 0)
+            for i, item := range items {
+                if len(item) == 0 && i == len(items) - 1 {
+                    break
+                }
+                if strings.HasPrefix(item, "[") || strings.HasPrefix(item, "{") {
+                    return nil, fmt.Errorf("Unsupported nested array or inline table")
+                }
+                v, e := parseTOMLValue(item)
+                if e != nil {
+                    return nil, e
+                }
+                values = append(values, v...)
+            }
+            return values, nil
+        default:
+            if strings.IndexAny(str, " \t,\"'") >= 0 && ! isTOMLDateTime(str) {
+                return nil, fmt.Errorf("Invalid value %q", str)
+            }
+            return []ConfigEntry{{Value: str}}, nil
+    }
+    if e != nil {
+        return nil, e
+    }
+    if len(strings.TrimSpace(rest)) > 0 {
+        return nil, fmt.Errorf("Unexpected %q after quoted value", rest)
+    }
+    return []ConfigEntry{{Value: value, Literal: str[0] == '\''}}, nil
+}
+
+/*
+whether a bare value is a date and time separated by a space, e.g.
+1979-05-27 07:32:00
+*/
+func isTOMLDateTime(str string) bool {
+    parts := strings.Split(str, " ")
+    return len(parts) == 2 && strings.Count(parts[0], "-") == 2 && strings.Count(parts[1], ":") >= 1
+}
@@ -0,0 +1,184 @@
+package structarg
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+)
+
+func entriesString(entries []ConfigEntry, lines bool) string {
+    strs := make([]string, len(entries))
+    for i, entry := range entries {
+        strs[i] = fmt.Sprintf("[%s]%s=%s", entry.Section, entry.Key, entry.Value)
+        if lines {
+            strs[i] = fmt.Sprintf("%d:%s", entry.Line, strs[i])
+        }
+    }
+    return strings.Join(strs, " ")
+}
+
+func TestDecodeConfig(t *testing.T) {
+    expect := "[]timeout=30 []debug=true []tags=a []tags=b []region=east [db]host=h [server.create]flavor=small"
+    cases := []struct {
+        decoder ConfigDecoder
+        content string
+    } {
+        {decodeJSONConfig, `{
+    "timeout": 30,
+    "debug": true,
+    "tags": ["a", "b"],
+    "region": "east", "secret": null,
+    "db": {"host": "h"},
+    "server": {"create": {"flavor": "small"}}
+}`},
+        {decodeYAMLConfig, `# comment
+timeout: 30
+debug: true # comment
+tags: [a, 'b']
+region: "east"
+db: {}
+server:
+  create:
+    flavor: small
+`},
+        {decodeTOMLConfig, `# comment
+timeout = 30
+debug = true # comment
+tags = ["a", 'b']
+region = "east"
+db.host = "h"
+[server.create]
+flavor = "small"
+`},
+    }
+    for i, c := range cases {
+        entries, e := c.decoder("test.conf", strings.NewReader(c.content))
+        if i == 1 {
+            // YAML flow mappings are not supported
+            if e == nil || ! strings.Contains(e.Error(), "test.conf:6: Unsupported flow mapping") {
+                t.Errorf("decode YAML error %v", e)
+            }
+            c.content = strings.Replace(c.content, "db: {}", "db:\n  host: h", 1)
+            entries, e = c.decoder("test.conf", strings.NewReader(c.content))
+        }
+        if e != nil {
+            t.Errorf("decode %d error %s", i, e)
+            continue
+        }
+        if entriesString(entries, false) != expect {
+            t.Errorf("decode %d = %s", i, entriesString(entries, false))
+        }
+    }
+}
+
+func TestDecodeYAMLConfig(t *testing.T) {
+    content := "---\n" +
+            "tags:\n" +
+            "- a\n" +
+            "-\n" +
+            "-   'it''s'\n" +
+            "url: http://host/path#frag\n" +
+            "empty:\n" +
+            "name: ~\n" +
+            "\"quoted key\": \"a # b\"\n" +
+            "test:\n" +
+            "    list:\n" +
+            "        - x\n" +
+            "        - \"y\"\n" +
+            "    arg1: value\n"
+    expect := "3:[]tags=a 5:[]tags=it's 6:[]url=http://host/path#frag 9:[]quoted key=a # b 12:[test]list=x 13:[test]list=y 14:[test]arg1=value"
+    entries, e := decodeYAMLConfig("test.yaml", strings.NewReader(content))
+    if e != nil {
+        t.Fatalf("decodeYAMLConfig error %s", e)
+    }
+    if entriesString(entries, true) != expect {
+        t.Errorf("decodeYAMLConfig = %s", entriesString(entries, true))
+    }
+    entries, e = decodeYAMLConfig("test.yaml", strings.NewReader("hosts:\n  -\n  - a\n"))
+    if e != nil || entriesString(entries, true) != "3:[]hosts=a" {
+        t.Errorf("decodeYAMLConfig null item = %s %v", entriesString(entries, true), e)
+    }
+}
+
+func TestDecodeTOMLConfig(t *testing.T) {
+    content := "title = 'C:\\dir' # literal\n" +
+            "ports = [\n" +
+            "    80, # http\n" +
+            "    443,\n" +
+            "]\n" +
+            "date = 1979-05-27 07:32:00\n" +
+            "[\"profile prod\"]\n" +
+            "\"key.with.dots\" = \"x\"\n" +
+            "[profile-x.test]\n" +
+            "arg1 = \"a#b\"\n"
+    expect := "1:[]title=C:\\dir 2:[]ports=80 2:[]ports=443 6:[]date=1979-05-27 07:32:00 8:[profile prod]key.with.dots=x 10:[profile-x.test]arg1=a#b"
+    entries, e := decodeTOMLConfig("test.toml", strings.NewReader(content))
+    if e != nil {
+        t.Fatalf("decodeTOMLConfig error %s", e)
+    }
+    if entriesString(entries, true) != expect {
+        t.Errorf("decodeTOMLConfig = %s", entriesString(entries, true))
+    }
+}
+
+func TestDecodeConfigError(t *testing.T) {
+    cases := []struct {
+        decoder ConfigDecoder
+        content string
+        err string
+    } {
+        {decodeJSONConfig, "[1, 2]", "test.conf:1: JSON configuration must be an object"},
+        {decodeJSONConfig, "{\n\"a\": 1,\n}", "test.conf:2: invalid character"},
+        {decodeJSONConfig, "{\"a\": [{\"b\": 1}]}", "test.conf:1: Unsupported array"},
+        {decodeJSONConfig, "{} {}", "test.conf:1: Unexpected data"},
+        {decodeYAMLConfig, "a: 1\n  b: 2\n", "test.conf:2: Unexpected indentation"},
+        {decodeYAMLConfig, "a: 1\n\tb: 2\n", "test.conf:2: Tabs are not allowed"},
+        {decodeYAMLConfig, "a:\n  - b: 1\n", "test.conf:2: Unsupported sequence of mappings"},
+        {decodeYAMLConfig, "a: |\n  text\n", "test.conf:1: Unsupported block scalar"},
+        {decodeYAMLConfig, "a: &x 1\n", "test.conf:1: Unsupported anchor"},
+        {decodeYAMLConfig, "- a\n", "test.conf:1: Unexpected sequence item"},
+        {decodeYAMLConfig, "a\n", "test.conf:1: Misformated line"},
+        {decodeYAMLConfig, "a: [1, 2\n", "test.conf:1: Unterminated flow sequence"},
+        {decodeTOMLConfig, "[[a]]\n", "test.conf:1: Unsupported array of tables"},
+        {decodeTOMLConfig, "a = { b = 1 }\n", "test.conf:1: Unsupported inline table"},
+        {decodeTOMLConfig, "a = \"\"\"\ntext\"\"\"\n", "test.conf:1: Unsupported multi-line string"},
+        {decodeTOMLConfig, "a = [[1], [2]]\n", "test.conf:1: Unsupported nested array"},
+        {decodeTOMLConfig, "a = hello world\n", "test.conf:1: Invalid value"},
+        {decodeTOMLConfig, "a b = 1\n", "test.conf:1: Invalid key"},
+        {decodeTOMLConfig, "a\n", "test.conf:1: Misformated line"},
+        {decodeTOMLConfig, "\na = \"abc\n", "test.conf:2: Unterminated"},
+    }
+    for _, c := range cases {
+        _, e := c.decoder("test.conf", strings.NewReader(c.content))
+        if e == nil || ! strings.HasPrefix(e.Error(), c.err) {
+            t.Errorf("decode %q error %v, expect %s", c.content, e, c.err)
+        }
+    }
+}
+
+func TestFindConfigDecoder(t *testing.T) {
+    RegisterConfigDecoder("TEST", decodeJSONConfig)
+    defer delete(configDecoders, "test")
+    cases := []struct {
+        filename string
+        format string
+        decoder ConfigDecoder
+    } {
+        {"a.json", "", decodeJSONConfig},
+        {"a.YML", "", decodeYAMLConfig},
+        {"a.toml", "", decodeTOMLConfig},
+        {"a.conf", "", parseConfigEntries},
+        {"climcrc", "", parseConfigEntries},
+        {"a.conf", "yaml", decodeYAMLConfig},
+        {"a.test", "", decodeJSONConfig},
+    }
+    for _, c := range cases {
+        decoder, e := findConfigDecoder(c.filename, c.format)
+        if e != nil || fmt.Sprintf("%p", decoder) != fmt.Sprintf("%p", c.decoder) {
+            t.Errorf("findConfigDecoder %s %s error %v", c.filename, c.format, e)
+        }
+    }
+    if _, e := findConfigDecoder("a.conf", "xml"); e == nil {
+        t.Errorf("Unknown format should be an error")
+    }
+}
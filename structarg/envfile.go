@@ -0,0 +1,137 @@
+package structarg
+
+import (
+    "io"
+    "bufio"
+    "os"
+    "fmt"
+    "strings"
+)
+
+/*
+the value of a line of a .env file: a double-quoted value may contain
+the escapes \n, \t, \r, \\ and \", a single-quoted value is literal, an
+unquoted value ends at a # preceded by a space
+*/
+func parseEnvValue(str string) (string, error) {
+    if len(str) > 0 && str[0] == '\'' {
+        pos := strings.IndexByte(str[1:], '\'')
+        if pos < 0 {
+            return "", fmt.Errorf("Unterminated quoted value")
+        }
+        rest := strings.TrimSpace(str[pos+2:])
+        if len(rest) > 0 && rest[0] != '#' {
+            return "", fmt.Errorf("Unexpected %q after quoted value", rest)
+        }
+        return str[1:pos+1], nil
+    }
+    if len(str) > 0 && str[0] == '"' {
+        value, rest, e := parseQuotedValue(str)
+        if e != nil {
+            return "", e
+        }
+        rest = strings.TrimSpace(rest)
+        if len(rest) > 0 && rest[0] != '#' {
+            return "", fmt.Errorf("Unexpected %q after quoted value", rest)
+        }
+        return value, nil
+    }
+    for i := 1; i < len(str); i ++ {
+        if str[i] == '#' && (str[i-1] == ' ' || str[i-1] == '\t') {
+            return strings.TrimSpace(str[:i]), nil
+        }
+    }
+    return str, nil
+}
+
+/*
+read the variables of a .env file of KEY=VALUE lines. Blank lines and
+lines starting with # are ignored, a line may start with "export ". A
+later line overrides an earlier line of the same key.
+*/
+func parseEnvFile(filename string, reader io.Reader) (map[string]string, error) {
+    vars := make(map[string]string)
+    scanner := bufio.NewScanner(reader)
+    lineno := 0
+    for scanner.Scan() {
+        lineno += 1
+        line := strings.TrimSpace(scanner.Text())
+        if len(line) == 0 || line[0] == '#' {
+            continue
+        }
+        if strings.HasPrefix(line, "export ") || strings.HasPrefix(line, "export\t") {
+            line = strings.TrimSpace(line[len("export"):])
+        }
+        pos := strings.IndexByte(line, '=')
+        if pos <= 0 {
+            return nil, configError(filename, lineno, "Misformated line: %s", line)
+        }
+        key := strings.TrimSpace(line[:pos])
+        if ! isEnvName(key) {
+            return nil, configError(filename, lineno, "Invalid variable name %s", key)
+        }
+        value, e := parseEnvValue(strings.TrimSpace(line[pos+1:]))
+        if e != nil {
+            return nil, configError(filename, lineno, "%s", e)
+        }
+        vars[key] = value
+    }
+    if e := scanner.Err(); e != nil {
+        return nil, e
+    }
+    return vars, nil
+}
+
+func (this *ArgumentParser) setEnvVars(vars map[string]string) {
+    if len(vars) == 0 {
+        return
+    }
+    if this.envVars == nil {
+        this.envVars = make(map[string]string)
+    }
+    for k, v := range vars {
+        this.envVars[k] = v
+    }
+    subcmd := this.GetSubcommand()
+    if subcmd != nil {
+        for _, data := range subcmd.subcommands {
+            data.parser.setEnvVars(vars)
+        }
+    }
+}
+
+/*
+load the variables of a .env file of KEY=VALUE lines, optionally
+prefixed by "export ", with quoted values and # comments. The variables
+are seen by env bindings and defaults of the parser and the parsers of
+subcommands, the process environment is not changed and overrides them.
+*/
+func (this *ArgumentParser) LoadEnvFile(path string) error {
+    file, e := os.Open(path)
+    if e != nil {
+        return e
+    }
+    defer file.Close()
+    vars, e := parseEnvFile(path, file)
+    if e != nil {
+        return e
+    }
+    this.setEnvVars(vars)
+    return nil
+}
+
+/*
+load the .env file of the env file argument, see builtinFilePath, then
+apply the environment variables again
+*/
+func (this *ArgumentParser) loadEnvFile(args []string) error {
+    path, e := this.builtinFilePath(this.envFileArg, args)
+    if e != nil || len(path) == 0 {
+        return e
+    }
+    e = this.LoadEnvFile(path)
+    if e != nil {
+        return e
+    }
+    return this.applyEnv()
+}
@@ -0,0 +1,55 @@
+package structarg
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestParseEnvFile(t *testing.T) {
+    content := "# comment\n" +
+            "\n" +
+            "A=1\n" +
+            "export B = two words # comment\n" +
+            "C=\"a \\\"b\\\"\\nc\" # comment\n" +
+            "D='${NOT_EXPANDED} \\n'\n" +
+            "E=\n" +
+            "F=http://host/path#frag\n" +
+            "A=override\n"
+    vars, e := parseEnvFile("test.env", strings.NewReader(content))
+    if e != nil {
+        t.Fatalf("parseEnvFile error %s", e)
+    }
+    expect := map[string]string{
+        "A": "override",
+        "B": "two words",
+        "C": "a \"b\"\nc",
+        "D": "${NOT_EXPANDED} \\n",
+        "E": "",
+        "F": "http://host/path#frag",
+    }
+    if ! reflect.DeepEqual(vars, expect) {
+        t.Errorf("parseEnvFile = %v", vars)
+    }
+}
+
+func TestParseEnvFileError(t *testing.T) {
+    cases := []struct {
+        content string
+        err string
+    } {
+        {"A\n", "test.env:1: Misformated line"},
+        {"A=1\n=2\n", "test.env:2: Misformated line"},
+        {"1A=1\n", "test.env:1: Invalid variable name 1A"},
+        {"A B=1\n", "test.env:1: Invalid variable name A B"},
+        {"A=\"abc\n", "test.env:1: Unterminated"},
+        {"A='abc\n", "test.env:1: Unterminated"},
+        {"A='abc' def\n", "test.env:1: Unexpected"},
+    }
+    for _, c := range cases {
+        _, e := parseEnvFile("test.env", strings.NewReader(c.content))
+        if e == nil || ! strings.HasPrefix(e.Error(), c.err) {
+            t.Errorf("parseEnvFile %q error %v, expect %s", c.content, e, c.err)
+        }
+    }
+}
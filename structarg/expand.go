@@ -0,0 +1,201 @@
+package structarg
+
+import (
+    "os"
+    "fmt"
+    "strings"
+)
+
+/*
+lookup of an environment variable, e.g. os.LookupEnv
+*/
+type envLookup func(name string) (string, bool)
+
+func isEnvName(name string) bool {
+    if len(name) == 0 {
+        return false
+    }
+    for i, c := range name {
+        if c != '_' && ! (c >= 'a' && c <= 'z') && ! (c >= 'A' && c <= 'Z') && ! (i > 0 && c >= '0' && c <= '9') {
+            return false
+        }
+    }
+    return true
+}
+
+/*
+find the closing brace of a ${ at the start of a string, nested ${ are
+skipped, an escaped $${ is not a variable
+*/
+func findVariableEnd(str string) int {
+    depth := 0
+    for i := 0; i < len(str); i ++ {
+        if strings.HasPrefix(str[i:], "$${") {
+            i += 2
+        }else if strings.HasPrefix(str[i:], "${") {
+            depth ++
+            i ++
+        }else if str[i] == '}' {
+            depth --
+            if depth == 0 {
+                return i
+            }
+        }
+    }
+    return -1
+}
+
+/*
+expand a variable expression, i.e. the content of ${...}: NAME, or
+NAME:-fallback for a fallback if the variable is unset or empty, or
+NAME:?message for an error if the variable is unset or empty. The name
+of the first variable whose value is used is recorded in used, if not
+nil.
+*/
+func expandVariable(expr string, lookup envLookup, used *string) (string, error) {
+    name, op, arg := expr, "", ""
+    pos := strings.Index(expr, ":")
+    if pos >= 0 {
+        name, op, arg = expr[:pos], expr[pos:], ""
+        if strings.HasPrefix(op, ":-") || strings.HasPrefix(op, ":?") {
+            op, arg = expr[pos:pos+2], expr[pos+2:]
+        }
+    }
+    if ! isEnvName(name) || (len(op) > 0 && op != ":-" && op != ":?") {
+        return "", fmt.Errorf("Invalid variable ${%s}", expr)
+    }
+    val, _ := lookup(name)
+    if len(val) > 0 {
+        if used != nil && len(*used) == 0 {
+            *used = name
+        }
+        return val, nil
+    }
+    switch op {
+        case ":-":
+            return expandEnv(arg, lookup, used)
+        case ":?":
+            if len(arg) == 0 {
+                arg = "parameter null or not set"
+            }
+            return "", fmt.Errorf("%s: %s", name, arg)
+    }
+    return val, nil
+}
+
+/*
+expand a string in the manner of a shell: ${NAME}, ${NAME:-fallback},
+${NAME:?message} and a leading ~ for the home directory. $${ is a
+literal ${, a $ that does not start ${ is kept literally.
+*/
+func expandString(str string, lookup envLookup) (string, error) {
+    return expandEnv(str, lookup, nil)
+}
+
+/*
+expandString that records the name of the first variable whose value is
+used in used, if not nil
+*/
+func expandEnv(str string, lookup envLookup, used *string) (string, error) {
+    if str == "~" || strings.HasPrefix(str, "~/") {
+        home, _ := lookup("HOME")
+        if len(home) == 0 {
+            var e error
+            home, e = os.UserHomeDir()
+            if e != nil {
+                return "", e
+            }
+        }
+        str = home + str[1:]
+    }
+    if ! strings.Contains(str, "${") {
+        return str, nil
+    }
+    var buf strings.Builder
+    for i := 0; i < len(str); i ++ {
+        if strings.HasPrefix(str[i:], "$${") {
+            buf.WriteString("${")
+            i += 2
+            continue
+        }
+        if ! strings.HasPrefix(str[i:], "${") {
+            buf.WriteByte(str[i])
+            continue
+        }
+        end := findVariableEnd(str[i:])
+        if end < 0 {
+            return "", fmt.Errorf("Unterminated variable %s", str[i:])
+        }
+        val, e := expandVariable(str[i+2:i+end], lookup, used)
+        if e != nil {
+            return "", e
+        }
+        buf.WriteString(val)
+        i += end
+    }
+    return buf.String(), nil
+}
+
+/*
+whether a default refers to environment variables or the home directory,
+so that it is resolved when the arguments are parsed
+*/
+func isDynamicDefault(defval string) bool {
+    return strings.Contains(defval, "$") || strings.HasPrefix(defval, "~") || strings.Contains(defval, "|~")
+}
+
+/*
+split the alternatives of a default by |, a | inside ${...} does not
+split
+*/
+func splitDefaultAlternatives(defval string) []string {
+    alts := make([]string, 0)
+    start := 0
+    for i := 0; i < len(defval); i ++ {
+        if strings.HasPrefix(defval[i:], "$${") {
+            i += 2
+        }else if strings.HasPrefix(defval[i:], "${") {
+            end := findVariableEnd(defval[i:])
+            if end < 0 {
+                break
+            }
+            i += end
+        }else if defval[i] == '|' {
+            alts = append(alts, defval[start:i])
+            start = i + 1
+        }
+    }
+    return append(alts, defval[start:])
+}
+
+/*
+resolve a default of alternatives separated by |, the first non-empty
+alternative is the default. An alternative $NAME is the value of an
+environment variable, other alternatives are expanded by expandString.
+The source is the environment variable if the value comes from a set
+variable, otherwise the default.
+*/
+func resolveDefault(defval string, lookup envLookup) (string, ArgumentSource, error) {
+    src := ArgumentSource{Kind: SOURCE_DEFAULT}
+    for _, dv := range splitDefaultAlternatives(defval) {
+        if strings.HasPrefix(dv, "$") && isEnvName(dv[1:]) {
+            src = ArgumentSource{Kind: SOURCE_ENV, EnvVar: dv[1:]}
+            dv, _ = lookup(dv[1:])
+        }else {
+            src = ArgumentSource{Kind: SOURCE_DEFAULT}
+            used := ""
+            var e error
+            dv, e = expandEnv(dv, lookup, &used)
+            if e != nil {
+                return "", src, e
+            }
+            if len(used) > 0 {
+                src = ArgumentSource{Kind: SOURCE_ENV, EnvVar: used}
+            }
+        }
+        if len(dv) > 0 {
+            return dv, src, nil
+        }
+    }
+    return "", src, nil
+}
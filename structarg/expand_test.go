@@ -0,0 +1,95 @@
+package structarg
+
+import (
+    "strings"
+    "testing"
+)
+
+func testLookup(name string) (string, bool) {
+    env := map[string]string{"HOME": "/home/test", "USER": "test", "EMPTY": ""}
+    val, ok := env[name]
+    return val, ok
+}
+
+func TestExpandString(t *testing.T) {
+    cases := []struct {
+        str string
+        expect string
+    } {
+        {"plain", "plain"},
+        {"${HOME}/.climc/cache", "/home/test/.climc/cache"},
+        {"~/.climc", "/home/test/.climc"},
+        {"~", "/home/test"},
+        {"a~/b", "a~/b"},
+        {"$HOME/a", "$HOME/a"},
+        {"pa$$word", "pa$$word"},
+        {"${UNSET}", ""},
+        {"${UNSET:-fallback}", "fallback"},
+        {"${EMPTY:-fallback}", "fallback"},
+        {"${USER:-fallback}", "test"},
+        {"${UNSET:-${USER}-x}", "test-x"},
+        {"${UNSET:-a|b}", "a|b"},
+        {"${USER}@${HOME}", "test@/home/test"},
+        {"pa$${word}", "pa${word}"},
+        {"$${UNSET:?literal}", "${UNSET:?literal}"},
+        {"${UNSET:-$${x}}", "${x}"},
+        {"$$${USER}", "$${USER}"},
+    }
+    for _, c := range cases {
+        val, e := expandString(c.str, testLookup)
+        if e != nil || val != c.expect {
+            t.Errorf("expandString %s = %q %v, expect %q", c.str, val, e, c.expect)
+        }
+    }
+}
+
+func TestExpandStringError(t *testing.T) {
+    cases := []struct {
+        str string
+        err string
+    } {
+        {"${UNSET:?set UNSET to the cache dir}", "UNSET: set UNSET to the cache dir"},
+        {"${EMPTY:?}", "EMPTY: parameter null or not set"},
+        {"${UNSET", "Unterminated variable ${UNSET"},
+        {"${1A}", "Invalid variable ${1A}"},
+        {"${A:=b}", "Invalid variable ${A:=b}"},
+    }
+    for _, c := range cases {
+        _, e := expandString(c.str, testLookup)
+        if e == nil || e.Error() != c.err {
+            t.Errorf("expandString %s error %v, expect %s", c.str, e, c.err)
+        }
+    }
+}
+
+func TestResolveDefault(t *testing.T) {
+    cases := []struct {
+        defval string
+        expect string
+        source ArgumentSource
+    } {
+        {"literal", "literal", ArgumentSource{Kind: SOURCE_DEFAULT}},
+        {"$USER", "test", ArgumentSource{Kind: SOURCE_ENV, EnvVar: "USER"}},
+        {"$UNSET|$USER|x", "test", ArgumentSource{Kind: SOURCE_ENV, EnvVar: "USER"}},
+        {"$UNSET|x", "x", ArgumentSource{Kind: SOURCE_DEFAULT}},
+        {"${UNSET:-a|b}|c", "a|b", ArgumentSource{Kind: SOURCE_DEFAULT}},
+        {"$${a}|c", "${a}", ArgumentSource{Kind: SOURCE_DEFAULT}},
+        {"${UNSET}|~/x", "/home/test/x", ArgumentSource{Kind: SOURCE_DEFAULT}},
+        {"$UNSET", "", ArgumentSource{Kind: SOURCE_ENV, EnvVar: "UNSET"}},
+        {"${USER:?need user}", "test", ArgumentSource{Kind: SOURCE_ENV, EnvVar: "USER"}},
+        {"/home/${USER}/x", "/home/test/x", ArgumentSource{Kind: SOURCE_ENV, EnvVar: "USER"}},
+        {"${UNSET:-${USER}}", "test", ArgumentSource{Kind: SOURCE_ENV, EnvVar: "USER"}},
+        {"${EMPTY:-a}", "a", ArgumentSource{Kind: SOURCE_DEFAULT}},
+        {"~/x", "/home/test/x", ArgumentSource{Kind: SOURCE_DEFAULT}},
+    }
+    for _, c := range cases {
+        val, src, e := resolveDefault(c.defval, testLookup)
+        if e != nil || val != c.expect || src != c.source {
+            t.Errorf("resolveDefault %s = %q %s %v", c.defval, val, src, e)
+        }
+    }
+    _, _, e := resolveDefault("${UNSET:?required}|x", testLookup)
+    if e == nil || ! strings.Contains(e.Error(), "UNSET: required") {
+        t.Errorf("resolveDefault error %v", e)
+    }
+}
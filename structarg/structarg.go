@@ -2,9 +2,9 @@ package structarg
 
 import (
     "os"
+    "io/ioutil"
     "log"
     "bytes"
-    "bufio"
     "fmt"
     "strings"
     "reflect"
@@ -21,11 +21,100 @@ type Argument interface {
     IsPositional() bool
     IsMulti() bool
     IsSubcommand() bool
+    IsNumeric() bool
+    IsNegatable() bool
     HelpString(indent string) string
     String() string
     SetValue(val string) error
     DoAction() error
     Validate() error
+    IsSet() bool
+    Env() string
+    Source() ArgumentSource
+    ValueString() string
+    IsSecret() bool
+}
+
+/*
+the source of an argument is changed only by the parser, an argument
+that does not implement sourceSetter keeps no source
+*/
+type sourceSetter interface {
+    setSource(src ArgumentSource)
+    reset()
+}
+
+func setArgumentSource(arg Argument, src ArgumentSource) {
+    if setter, ok := arg.(sourceSetter); ok {
+        setter.setSource(src)
+    }
+}
+
+func resetArgument(arg Argument) {
+    if setter, ok := arg.(sourceSetter); ok {
+        setter.reset()
+    }
+}
+
+/*
+Where the value of an argument comes from
+*/
+type SourceKind int
+
+const (
+    SOURCE_NONE SourceKind = iota
+    SOURCE_DEFAULT
+    SOURCE_ENV
+    SOURCE_FILE
+    SOURCE_CLI
+)
+
+func (this SourceKind) String() string {
+    switch this {
+        case SOURCE_DEFAULT:
+            return "default"
+        case SOURCE_ENV:
+            return "env"
+        case SOURCE_FILE:
+            return "file"
+        case SOURCE_CLI:
+            return "command line"
+        default:
+            return "unset"
+    }
+}
+
+/*
+The source of the value of an argument, File and Line are set for a
+value from a configuration file, and Profile if the value is from a
+profile section, EnvVar for a value from an environment variable
+*/
+type ArgumentSource struct {
+    Kind SourceKind
+    File string
+    Line int
+    Profile string
+    EnvVar string
+}
+
+func (this ArgumentSource) String() string {
+    switch this.Kind {
+        case SOURCE_ENV:
+            return fmt.Sprintf("env %s", this.EnvVar)
+        case SOURCE_FILE:
+            var str string
+            if this.Line > 0 {
+                str = fmt.Sprintf("file %s:%d", this.File, this.Line)
+            }else {
+                str = fmt.Sprintf("file %s", this.File)
+            }
+            if len(this.Profile) > 0 {
+                str = fmt.Sprintf("%s profile %s", str, this.Profile)
+            }
+            return str
+        default:
+            return this.Kind.String()
+    }
 }
 
 type SingleArgument struct {
@@ -38,8 +127,16 @@ type SingleArgument struct {
     choices []string
     useDefault bool
     defValue reflect.Value
+    defRaw string
+    defSep string
+    defSource ArgumentSource
+    action string
+    constValue reflect.Value
+    env string
+    secret bool
     value reflect.Value
     isSet bool
+    source ArgumentSource
     parser *ArgumentParser
 }
 
@@ -47,6 +144,14 @@ type MultiArgument struct {
     SingleArgument
     minCount int64
     maxCount int64
+    count int
+    sep string
+}
+
+type MapArgument struct {
+    SingleArgument
+    sep string
+    override bool
 }
 
 type SubcommandArgumentData struct {
@@ -59,6 +164,74 @@ type SubcommandArgument struct {
     subcommands map[string]SubcommandArgumentData
 }
 
+/*
+How an optional argument may be abbreviated on the command line
+*/
+type AbbrevMode int
+
+const (
+    /*
+    a unique prefix of a long token is accepted, e.g. --deb for --debug
+    */
+    ABBREV_UNIQUE AbbrevMode = iota
+    /*
+    only exact long or short tokens are accepted
+    */
+    ABBREV_OFF
+    /*
+    a unique prefix of a long token is accepted with a warning
+    */
+    ABBREV_WARN
+)
+
+/*
+How an unknown key of a configuration file is handled
+*/
+type UnknownKeyMode int
+
+const (
+    /*
+    an unknown key is logged and skipped
+    */
+    UNKNOWN_KEY_WARN UnknownKeyMode = iota
+    /*
+    an unknown key is an error
+    */
+    UNKNOWN_KEY_STRICT
+    /*
+    an unknown key is skipped silently
+    */
+    UNKNOWN_KEY_IGNORE
+)
+
+/*
+A Logger prints the warnings of a parser, e.g. *log.Logger
+*/
+type Logger interface {
+    Printf(format string, v ...interface{})
+}
+
+/*
+the default logger prints by the standard logger of the log package
+*/
+type stdLogger struct {}
+
+func (this stdLogger) Printf(format string, v ...interface{}) {
+    log.Printf(format, v...)
+}
+
+const (
+    /*
+    the suffix of the environment variable that names the file of a
+    secret, e.g. DB_PASSWORD_FILE for DB_PASSWORD
+    */
+    SECRET_FILE_SUFFIX = "_FILE"
+    /*
+    the value of a secret in ConfigString
+    */
+    SECRET_REDACTED = "******"
+)
+
 type ArgumentParser struct {
     target interface{}
     prog string
@@ -66,14 +239,27 @@ type ArgumentParser struct {
     epilog string
     optArgs []Argument
     posArgs []Argument
+    abbrevMode AbbrevMode
+    unknownKeyMode UnknownKeyMode
+    logger Logger
+    envPrefix string
+    configArg *SingleArgument
+    profileArg *SingleArgument
+    envFileArg *SingleArgument
+    envVars map[string]string
+    configPaths []string
+    loadedFiles []string
 }
 
 func NewArgumentParser(target interface{}, prog, desc, epilog string) (*ArgumentParser, error) {
     parser := ArgumentParser{prog: prog, description: desc,
-                            epilog: epilog, target: target}
+                            epilog: epilog, target: target,
+                            abbrevMode: ABBREV_UNIQUE,
+                            unknownKeyMode: UNKNOWN_KEY_WARN,
+                            logger: stdLogger{}}
     target_type := reflect.TypeOf(target).Elem()
     target_value := reflect.ValueOf(target).Elem()
-    e := parser.addStructArgument(target_type, target_value)
+    e := parser.addStructArgument("", target_type, target_value, []reflect.Type{target_type})
     if e != nil {
         return nil, e
     }
@@ -109,6 +295,12 @@ const (
     TAG_METAVAR = "metavar"
     /*
     The default value of the argument.
+    Alternatives are separated by |, the first non-empty one is used,
+    e.g. default:"$AUTH_URL|http://localhost", where $NAME is the value of
+    an environment variable. A default may be expanded like in a shell
+    when parsing: ${NAME}, ${NAME:-fallback}, ${NAME:?error message} and
+    a leading ~ for the home directory, e.g. default:"${HOME}/.climc/cache".
+    $${ is a literal ${.
     the tag is optional
     */
     TAG_DEFAULT = "default"
@@ -130,25 +322,164 @@ const (
     */
     TAG_SUBCOMMAND = "subcommand"
     /*
-    The attribute defines the possible number of argument. Possible values
-    ar:
+    The attribute defines the possible number of argument of a slice or
+    array field. Possible values ar:
         * positive integers, e.g. "1", "2"
         * "*" any number of arguments
         * "+" at lease one argument
         * "?" at most one argument
-    the tag is optional, the default value is "1"
+    An optional argument consumes its values greedily from the following
+    arguments, e.g. "--hosts a b c", the number is checked for each
+    occurrence of the argument.
+    the tag is optional, the default value is "1" for an optional argument
+    with a separator, the length of an array, "+" for a non-optional
+    positional slice and "*" otherwise
     */
     TAG_NARGS = "nargs"
+    /*
+    Prefix of the tokens of all arguments in a nested or embedded struct,
+    e.g. prefix:"db-", the field Host of the struct will be "--db-host".
+    The prefix allows to embed the same struct more than once.
+    Arguments with a prefix have no short token.
+    the tag is optional
+    */
+    TAG_PREFIX = "prefix"
+    /*
+    Separator of the elements of a list value of a slice, array or map
+    field, e.g. sep:",", the command-line argument "--zones a,b,c" appends
+    three elements. The value from a configuration file or a default is
+    split as well.
+    the tag is optional
+    */
+    TAG_SEP = "sep"
+    /*
+    How a duplicate key of a map field is handled, a map argument is given
+    as key=value pairs, e.g. "--label env=prod --label tier=db".
+    Possible values are:
+        * "override" the last value of a key wins
+        * "error" a duplicate key is an error
+    the tag is optional, the default value is "override"
+    */
+    TAG_DUPLICATE = "duplicate"
+    /*
+    The action taken when an optional argument is given, see the ACTION_*
+    constants.
+    the tag is optional, the default value is "store"
+    */
+    TAG_ACTION = "action"
+    /*
+    The constant value of the actions "store_const" and "append_const"
+    the tag is required by these actions
+    */
+    TAG_CONST = "const"
+    /*
+    A boolean value marks an optional string argument as the path of a
+    configuration file, e.g. config:"true". The file is loaded by
+    ParseArgs before the other command-line arguments are applied. The
+    default value is loaded if the file exists.
+    The precedence of values is command line > configuration file >
+    environment variable > default.
+    the tag is optional, the default value is false
+    */
+    TAG_CONFIG = "config"
+    /*
+    A boolean value marks an optional string argument as the name of the
+    profile of configuration files, e.g. profile:"true". The keys of the
+    [profile name] section are overlaid onto the other keys, a profile
+    may inherit another profile by "inherits = name". An environment
+    variable may choose the profile by a default, e.g.
+    default:"$CLIMC_PROFILE", otherwise the profile "default" is used if
+    it exists.
+    the tag is optional, the default value is false
+    */
+    TAG_PROFILE = "profile"
+    /*
+    Environment variable of the argument, e.g. env:"OS_AUTH_URL", the
+    value of the variable is used if the argument is not given on the
+    command line or in a configuration file. "-" opts out of the
+    variable bound by the env prefix of the parser, see SetEnvPrefix.
+    the tag is optional
+    */
+    TAG_ENV = "env"
+    /*
+    A boolean value marks the argument as a secret, e.g. secret:"true".
+    A value @path is read from the file path with trailing newlines
+    trimmed, @@ escapes a value starting with @. If the environment
+    variable NAME of the argument is empty, the file named by NAME_FILE
+    is read. The value is redacted in ConfigString.
+    the tag is optional, the default value is false
+    */
+    TAG_SECRET = "secret"
+    /*
+    A boolean value marks an optional string argument as the path of a
+    .env file, e.g. env-file:"true". The variables of the file are
+    loaded by LoadEnvFile before the environment variables are applied,
+    a default value is loaded if the file exists.
+    the tag is optional, the default value is false
+    */
+    TAG_ENV_FILE = "env-file"
+)
+
+const (
+    /*
+    store the value of the argument, a boolean argument is set without value
+    */
+    ACTION_STORE = "store"
+    /*
+    count the occurrences of the argument in an integer field,
+    e.g. "-vvv" sets 3
+    */
+    ACTION_COUNT = "count"
+    /*
+    store the value of the tag "const" without value
+    */
+    ACTION_STORE_CONST = "store_const"
+    /*
+    append the value of the tag "const" to a slice field without value
+    */
+    ACTION_APPEND_CONST = "append_const"
+    /*
+    append one value to a slice field each time the argument is given,
+    e.g. "--flag x --flag y"
+    */
+    ACTION_APPEND = "append"
 )
 
-func (this *ArgumentParser) addStructArgument(tp reflect.Type, val reflect.Value) error {
+/*
+add the fields of a struct as arguments, parents are the struct types
+being walked, a pointer to one of them is a cycle
+*/
+func (this *ArgumentParser) addStructArgument(prefix string, tp reflect.Type, val reflect.Value, parents []reflect.Type) error {
     for i := 0; i < tp.NumField(); i ++ {
         f := tp.Field(i)
         v := val.Field(i)
-        if f.Type.Kind() == reflect.Struct {
-            return this.addStructArgument(f.Type, v)
-        }else {
-            e := this.addArgument(f, v)
+        if len(f.PkgPath) > 0 && ! f.Anonymous {
+            // unexported field
+            continue
+        }
+        ftype := f.Type
+        if ftype.Kind() == reflect.Ptr && ftype.Elem().Kind() == reflect.Struct {
+            for _, parent := range parents {
+                if parent == ftype.Elem() {
+                    return fmt.Errorf("Cyclic struct pointer %s of %s", f.Name, ftype.Elem())
+                }
+            }
+            if v.IsNil() {
+                if ! v.CanSet() {
+                    return fmt.Errorf("Cannot allocate struct pointer %s", f.Name)
+                }
+                v.Set(reflect.New(ftype.Elem()))
+            }
+            ftype = ftype.Elem()
+            v = v.Elem()
+        }
+        if ftype.Kind() == reflect.Struct {
+            e := this.addStructArgument(prefix + f.Tag.Get(TAG_PREFIX), ftype, v, append(parents[:len(parents):len(parents)], ftype))
+            if e != nil {
+                return e
+            }
+        }else if len(f.PkgPath) == 0 {
+            e := this.addArgument(prefix, f, v)
             if e != nil {
                 return e
             }
@@ -157,25 +488,45 @@ func (this *ArgumentParser) addStructArgument(tp reflect.Type, val reflect.Value
     return nil
 }
 
-func (this *ArgumentParser) addArgument(f reflect.StructField, v reflect.Value) error {
+/*
+parse a default value of a type, the items of a slice or map default are
+separated by sep
+*/
+func parseDefaultValue(defval string, tp reflect.Type, sep string) (reflect.Value, error) {
+    var defval_t reflect.Value
+    var e error
+    if tp.Kind() == reflect.Map {
+        defval_t = reflect.MakeMap(tp)
+        e = setMapValues(defval_t, defval, sep, true)
+    }else if len(sep) > 0 {
+        defval_t = reflect.New(tp).Elem()
+        e = gotypes.AppendValues(defval_t, splitValues(defval, sep)...)
+    }else {
+        defval_t, e = gotypes.ParseValue(defval, tp)
+    }
+    return defval_t, e
+}
+
+func (this *ArgumentParser) addArgument(prefix string, f reflect.StructField, v reflect.Value) error {
     help := f.Tag.Get(TAG_HELP)
     token := f.Tag.Get(TAG_TOKEN)
     if len(token) == 0 {
         token = f.Name
     }
+    token = prefix + token
     shorttoken := f.Tag.Get(TAG_SHORT_TOKEN)
+    if len(prefix) > 0 {
+        shorttoken = ""
+    }
     metavar := f.Tag.Get(TAG_METAVAR)
     defval := f.Tag.Get(TAG_DEFAULT)
-    if len(defval) > 0 {
-        for _, dv := range strings.Split(defval, "|") {
-            if dv[0] == '$' {
-                dv = os.Getenv(strings.TrimLeft(dv, "$"))
-            }
-            defval = dv
-            if len(defval) > 0 {
-                break
-            }
-        }
+    defsrc := ArgumentSource{Kind: SOURCE_DEFAULT}
+    // a default of environment variables is resolved when parsing
+    defraw := ""
+    if isDynamicDefault(defval) {
+        defraw = defval
+    }else if len(defval) > 0 {
+        defval, defsrc, _ = resolveDefault(defval, this.lookupEnv)
     }
     use_default := true
     if len(defval) == 0 {
@@ -213,9 +564,13 @@ func (this *ArgumentParser) addArgument(f reflect.StructField, v reflect.Value)
     if e != nil {
         subcommand = false
     }
+    sep := f.Tag.Get(TAG_SEP)
+    if len(sep) > 0 && f.Type.Kind() != reflect.Slice && f.Type.Kind() != reflect.Array && f.Type.Kind() != reflect.Map {
+        return fmt.Errorf("Tag %s requires a slice or map field, %s is %s", TAG_SEP, f.Name, f.Type)
+    }
     var defval_t reflect.Value
-    if use_default {
-        defval_t, e = gotypes.ParseValue(defval, f.Type)
+    if use_default && len(defraw) == 0 {
+        defval_t, e = parseDefaultValue(defval, f.Type, sep)
         if e != nil {
             return e
         }
@@ -224,21 +579,53 @@ func (this *ArgumentParser) addArgument(f reflect.StructField, v reflect.Value)
         positional = true
         optional = false
     }
+    secret, e := strconv.ParseBool(f.Tag.Get(TAG_SECRET))
+    if e != nil {
+        secret = false
+    }
     var arg Argument = nil
+    action, const_t, e := parseAction(f)
+    if e != nil {
+        return e
+    }
+    if action != ACTION_STORE && positional {
+        return fmt.Errorf("Action %s of %s requires an optional argument", action, f.Name)
+    }
     sarg := SingleArgument{token: token, shortToken: shorttoken,
                     optional: optional, positional: positional,
                     metavar: metavar, help: help,
                     choices: choices,
                     useDefault: use_default,
                     defValue: defval_t,
+                    defSource: defsrc,
+                    defRaw: defraw,
+                    defSep: sep,
+                    action: action,
+                    constValue: const_t,
+                    env: f.Tag.Get(TAG_ENV),
+                    secret: secret,
                     value: v, parser: this}
     if subcommand {
         arg = &SubcommandArgument{SingleArgument: sarg,
                         subcommands: make(map[string]SubcommandArgumentData)}
-    }else if f.Type.Kind() == reflect.Array {
+    }else if f.Type.Kind() == reflect.Slice || f.Type.Kind() == reflect.Array {
         var min, max int64
         var e error
         nargs := f.Tag.Get(TAG_NARGS)
+        if action == ACTION_APPEND {
+            nargs = "1"
+        }
+        if len(nargs) == 0 {
+            if len(sep) > 0 && ! positional {
+                nargs = "1"
+            }else if f.Type.Kind() == reflect.Array {
+                nargs = strconv.Itoa(f.Type.Len())
+            }else if positional && ! optional {
+                nargs = "+"
+            }else {
+                nargs = "*"
+            }
+        }
         if nargs == "*" {
             min = 0
             max = -1
@@ -250,20 +637,109 @@ func (this *ArgumentParser) addArgument(f reflect.StructField, v reflect.Value)
             max = -1
         }else {
             min, e = strconv.ParseInt(nargs, 10, 64)
-            if e == nil {
+            if e == nil && min > 0 {
                 max = min
             }else {
                 return fmt.Errorf("Unknown nargs pattern %s", nargs)
             }
         }
+        if f.Type.Kind() == reflect.Array && (max < 0 || max > int64(f.Type.Len())) {
+            return fmt.Errorf("nargs %s exceeds the length %d of array %s", nargs, f.Type.Len(), f.Name)
+        }
         arg = &MultiArgument{SingleArgument: sarg,
-                    minCount: min, maxCount: max}
+                    minCount: min, maxCount: max, sep: sep}
+    }else if f.Type.Kind() == reflect.Map {
+        if positional {
+            return fmt.Errorf("Map argument %s must be optional", f.Name)
+        }
+        duplicate := f.Tag.Get(TAG_DUPLICATE)
+        if len(duplicate) == 0 {
+            duplicate = "override"
+        }
+        if duplicate != "override" && duplicate != "error" {
+            return fmt.Errorf("Unknown duplicate policy %s", duplicate)
+        }
+        if len(sarg.metavar) == 0 {
+            // the metavar is used by String of the embedded SingleArgument
+            sarg.metavar = "KEY=VALUE"
+        }
+        arg = &MapArgument{SingleArgument: sarg, sep: sep,
+                    override: duplicate == "override"}
     }else {
         arg = &sarg
     }
+    e = this.setBuiltinArgument(&this.configArg, "Config", TAG_CONFIG, f, &sarg)
+    if e != nil {
+        return e
+    }
+    e = this.setBuiltinArgument(&this.profileArg, "Profile", TAG_PROFILE, f, &sarg)
+    if e != nil {
+        return e
+    }
+    e = this.setBuiltinArgument(&this.envFileArg, "Env file", TAG_ENV_FILE, f, &sarg)
+    if e != nil {
+        return e
+    }
     return this.AddArgument(arg)
 }
 
+/*
+record an argument marked by a boolean tag, e.g. config:"true", as a
+built-in argument of the parser, which must be a unique optional string
+*/
+func (this *ArgumentParser) setBuiltinArgument(target **SingleArgument, name string, tag string, f reflect.StructField, sarg *SingleArgument) error {
+    builtin, e := strconv.ParseBool(f.Tag.Get(tag))
+    if e != nil || ! builtin {
+        return nil
+    }
+    if sarg.positional || f.Type != gotypes.StringType {
+        return fmt.Errorf("%s argument %s must be an optional string", name, f.Name)
+    }
+    if *target != nil {
+        return fmt.Errorf("Duplicate %s argument %s", strings.ToLower(name), f.Name)
+    }
+    *target = sarg
+    return nil
+}
+
+/*
+parse the action and const tags of a field
+*/
+func parseAction(f reflect.StructField) (string, reflect.Value, error) {
+    var const_t reflect.Value
+    var e error
+    action := f.Tag.Get(TAG_ACTION)
+    if len(action) == 0 {
+        action = ACTION_STORE
+    }
+    constval, has_const := f.Tag.Lookup(TAG_CONST)
+    if has_const != (action == ACTION_STORE_CONST || action == ACTION_APPEND_CONST) {
+        return action, const_t, fmt.Errorf("Tag %s of %s is required by and only allowed for actions %s and %s", TAG_CONST, f.Name, ACTION_STORE_CONST, ACTION_APPEND_CONST)
+    }
+    switch action {
+        case ACTION_STORE:
+        case ACTION_COUNT:
+            switch f.Type.Kind() {
+                case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+                case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+                default:
+                    return action, const_t, fmt.Errorf("Action %s requires an integer field, %s is %s", action, f.Name, f.Type)
+            }
+        case ACTION_STORE_CONST:
+            const_t, e = gotypes.ParseValue(constval, f.Type)
+        case ACTION_APPEND_CONST, ACTION_APPEND:
+            if f.Type.Kind() != reflect.Slice {
+                return action, const_t, fmt.Errorf("Action %s requires a slice field, %s is %s", action, f.Name, f.Type)
+            }
+            if action == ACTION_APPEND_CONST {
+                const_t, e = gotypes.ParseValue(constval, f.Type.Elem())
+            }
+        default:
+            return action, const_t, fmt.Errorf("Unknown action %s of %s", action, f.Name)
+    }
+    return action, const_t, e
+}
+
 func (this *ArgumentParser) AddArgument(arg Argument) error {
     if arg.IsPositional() {
         if len(this.posArgs) > 0 {
@@ -279,6 +755,21 @@ func (this *ArgumentParser) AddArgument(arg Argument) error {
         }
         this.posArgs = append(this.posArgs, arg)
     }else {
+        for _, opt := range this.optArgs {
+            if opt.Token() == arg.Token() {
+                return fmt.Errorf("Duplicate argument token --%s", arg.Token())
+            }
+            if len(arg.ShortToken()) > 0 && opt.ShortToken() == arg.ShortToken() {
+                return fmt.Errorf("Duplicate argument short token -%s", arg.ShortToken())
+            }
+            // --no-TOKEN of a negatable argument must not shadow a token
+            if opt.IsNegatable() && arg.Token() == "no-" + opt.Token() {
+                return fmt.Errorf("Argument token --%s conflicts with the negation of --%s", arg.Token(), opt.Token())
+            }
+            if arg.IsNegatable() && opt.Token() == "no-" + arg.Token() {
+                return fmt.Errorf("Negation of argument token --%s conflicts with --%s", arg.Token(), opt.Token())
+            }
+        }
         this.optArgs = append(this.optArgs, arg)
     }
     return nil
@@ -289,13 +780,32 @@ func (this *ArgumentParser) Options() interface{} {
 }
 
 func (this *SingleArgument) NeedData() bool {
-    if this.value.Kind() == reflect.Bool {
+    switch this.action {
+        case ACTION_COUNT, ACTION_STORE_CONST, ACTION_APPEND_CONST:
+            return false
+    }
+    if this.isBool() {
         return false
     }else {
         return true
     }
 }
 
+/*
+whether the argument is a bool or a pointer to bool
+*/
+func (this *SingleArgument) isBool() bool {
+    tp := this.value.Type()
+    return tp == gotypes.BoolType || (tp.Kind() == reflect.Ptr && tp.Elem() == gotypes.BoolType)
+}
+
+/*
+whether the argument has a negated token, e.g. --no-cache for --cache
+*/
+func (this *SingleArgument) IsNegatable() bool {
+    return ! this.positional && this.action == ACTION_STORE && this.isBool()
+}
+
 func (this *SingleArgument) MetaVar() string {
     if len(this.metavar) > 0 {
         return this.metavar
@@ -331,6 +841,73 @@ func splitCamelString(str string) string {
     return buf.String()
 }
 
+/*
+optimal string alignment distance between two strings, i.e. the number of
+insertions, deletions, substitutions and transpositions of adjacent
+characters that turns one string into the other
+*/
+func editDistance(a, b string) int {
+    d := make([][]int, len(a) + 1)
+    for i := range d {
+        d[i] = make([]int, len(b) + 1)
+        d[i][0] = i
+    }
+    for j := 0; j <= len(b); j ++ {
+        d[0][j] = j
+    }
+    for i := 1; i <= len(a); i ++ {
+        for j := 1; j <= len(b); j ++ {
+            cost := 1
+            if a[i-1] == b[j-1] {
+                cost = 0
+            }
+            d[i][j] = d[i-1][j] + 1
+            if d[i][j-1] + 1 < d[i][j] {
+                d[i][j] = d[i][j-1] + 1
+            }
+            if d[i-1][j-1] + cost < d[i][j] {
+                d[i][j] = d[i-1][j-1] + cost
+            }
+            if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && d[i-2][j-2] + 1 < d[i][j] {
+                d[i][j] = d[i-2][j-2] + 1
+            }
+        }
+    }
+    return d[len(a)][len(b)]
+}
+
+/*
+suggest the candidate closest to a mistyped string, returns an empty
+string if no candidate is close enough. The leading dashes of tokens are
+not compared, a candidate must keep more than the edited characters of
+both strings, and a number is never mistyped.
+*/
+func suggestString(str string, candidates []string) string {
+    if _, e := strconv.ParseFloat(str, 64); e == nil {
+        return ""
+    }
+    var suggest string
+    var min_dist = len(str) / 3 + 2
+    name := strings.ToLower(strings.TrimLeft(str, "-"))
+    for _, cand := range candidates {
+        cand_name := strings.ToLower(strings.TrimLeft(cand, "-"))
+        dist := editDistance(name, cand_name)
+        if dist < min_dist && dist < len(name) && dist < len(cand_name) {
+            suggest = cand
+            min_dist = dist
+        }
+    }
+    return suggest
+}
+
+func didYouMean(str string, candidates []string, quote string) string {
+    suggest := suggestString(str, candidates)
+    if len(suggest) > 0 {
+        return fmt.Sprintf(", did you mean %s%s%s?", quote, suggest, quote)
+    }
+    return ""
+}
+
 func (this *SingleArgument) Token() string {
     return splitCamelString(this.token)
 }
@@ -353,6 +930,8 @@ func (this *SingleArgument) String() string {
     }else {
         if this.NeedData() {
             return fmt.Sprintf("%c--%s %s%c", start, this.Token(), this.MetaVar(), end)
+        }else if this.IsNegatable() {
+            return fmt.Sprintf("%c--[no-]%s%c", start, this.Token(), end)
         }else {
             return fmt.Sprintf("%c--%s%c", start, this.Token(), end)
         }
@@ -375,6 +954,14 @@ func (this *SingleArgument) IsSubcommand() bool {
     return false
 }
 
+func (this *SingleArgument) IsNumeric() bool {
+    tp := this.value.Type()
+    if tp.Kind() == reflect.Ptr {
+        tp = tp.Elem()
+    }
+    return gotypes.IsNumericType(tp)
+}
+
 func (this *SingleArgument) HelpString(indent string) string {
     return indent + strings.Join(strings.Split(this.help, "\n"), "\n" + indent)
 }
@@ -392,9 +979,26 @@ func (this *SingleArgument) InChoices(val string) bool {
     }
 }
 
+/*
+the name of the argument in messages, the metavar of a positional
+argument or the long token of an optional argument
+*/
+func (this *SingleArgument) displayName() string {
+    if this.IsPositional() {
+        return this.MetaVar()
+    }
+    return "--" + this.Token()
+}
+
+func (this *SingleArgument) choiceError(val string) error {
+    name := this.displayName()
+    return fmt.Errorf("Unknown argument \"%s\" for %s, choose from {%s}%s", val, name,
+                        strings.Join(this.choices, ","), didYouMean(val, this.choices, "\""))
+}
+
 func (this *SingleArgument) SetValue(val string) error {
     if ! this.InChoices(val)  {
-        return fmt.Errorf("Unknown argument %s for %s%s", val, this.token, this.MetaVar())
+        return this.choiceError(val)
     }
     e := gotypes.SetValue(this.value, val)
     if e != nil {
@@ -405,78 +1009,340 @@ func (this *SingleArgument) SetValue(val string) error {
 }
 
 func (this *SingleArgument) DoAction() error {
-    if this.value.Type() == gotypes.BoolType {
-        if this.useDefault {
-            this.value.SetBool(!this.defValue.Bool())
-        }else {
-            this.value.SetBool(true)
-        }
-        this.isSet = true
+    switch this.action {
+        case ACTION_COUNT:
+            if ! this.isSet {
+                e := this.resolveDefault()
+                if e != nil {
+                    return e
+                }
+            }
+            if ! this.isSet && this.useDefault {
+                this.value.Set(this.defValue)
+            }
+            switch this.value.Kind() {
+                case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+                    this.value.SetUint(this.value.Uint() + 1)
+                default:
+                    this.value.SetInt(this.value.Int() + 1)
+            }
+            this.isSet = true
+            return nil
+        case ACTION_STORE_CONST:
+            this.value.Set(this.constValue)
+            this.isSet = true
+            return nil
+        case ACTION_APPEND_CONST:
+            this.value.Set(reflect.Append(this.value, this.constValue))
+            this.isSet = true
+            return nil
+    }
+    if this.isBool() {
+        return this.SetValue("true")
+    }
+    return nil
+}
+
+/*
+resolve a default that refers to environment variables or the home
+directory, when the arguments are parsed
+*/
+func (this *SingleArgument) resolveDefault() error {
+    if len(this.defRaw) == 0 {
+        return nil
+    }
+    defval, defsrc, e := resolveDefault(this.defRaw, this.parser.lookupEnv)
+    if e == nil && len(defval) > 0 {
+        this.defValue, e = parseDefaultValue(defval, this.value.Type(), this.defSep)
+    }
+    if e != nil && this.secret {
+        // the value of a secret is never part of an error
+        return fmt.Errorf("Invalid default of %s", this.displayName())
+    }else if e != nil {
+        return fmt.Errorf("Invalid default of %s: %s", this.displayName(), e)
     }
+    this.defSource = defsrc
+    this.useDefault = len(defval) > 0
     return nil
 }
 
 func (this *SingleArgument) Validate() error {
+    if ! this.isSet {
+        e := this.resolveDefault()
+        if e != nil {
+            return e
+        }
+    }
     if ! this.optional && ! this.isSet && ! this.useDefault {
         return fmt.Errorf("Non-optional argument %s not set", this.token)
     }
     if ! this.isSet && this.useDefault {
-        this.value.Set(this.defValue)
+        this.source = this.defSource
+        if this.value.Kind() == reflect.Ptr {
+            // each parse allocates a new value for the default
+            value := reflect.New(this.value.Type().Elem())
+            value.Elem().Set(this.defValue.Elem())
+            this.value.Set(value)
+        }else {
+            this.value.Set(this.defValue)
+        }
     }
     return nil
 }
 
-func (this *MultiArgument) IsMulti() bool {
-    return true
+/*
+whether the value of the argument is given on the command line, in a
+configuration file or by an environment variable, rather than by a
+literal default
+*/
+func (this *SingleArgument) IsSet() bool {
+    return this.source.Kind > SOURCE_DEFAULT
 }
 
-func (this *MultiArgument) SetValue(val string) error {
-    if ! this.InChoices(val)  {
-        return fmt.Errorf("Unknown argument %s for %s%s", val, this.Token(), this.MetaVar())
-    }
-    var e error = nil
-    e = gotypes.AppendValue(this.value, val)
-    if e != nil {
-        return e
-    }
-    this.isSet = true
-    return nil
+func (this *SingleArgument) Env() string {
+    return this.env
 }
 
-func (this *MultiArgument) Validate() error {
-    var e = this.SingleArgument.Validate()
-    if e != nil {
-        return e
-    }
-    var vallen int64 = int64(this.value.Len())
-    if (this.minCount >= 0 && vallen < this.minCount) {
-        return fmt.Errorf("Argument count requires at least %d", this.minCount)
-    }
-    if (this.maxCount >= 0 && vallen > this.maxCount) {
-        return fmt.Errorf("Argument count requires at most %d", this.maxCount)
-    }
-    return nil
+func (this *SingleArgument) IsSecret() bool {
+    return this.secret
 }
 
-func (this *SubcommandArgument) IsSubcommand() bool {
-    return true
+func (this *SingleArgument) Source() ArgumentSource {
+    return this.source
 }
 
-func (this *SubcommandArgument) String() string {
-    return fmt.Sprintf("<%s>", strings.ToUpper(this.token))
+func (this *SingleArgument) setSource(src ArgumentSource) {
+    this.source = src
 }
 
-func (this *SubcommandArgument) AddSubParser(target interface{}, command string, desc string, callback interface{}) (*ArgumentParser, error) {
-    prog := fmt.Sprintf("%s %s", this.parser.prog, command)
-    parser, e := NewArgumentParser(target, prog, desc, "")
-    if e != nil {
-        return nil, e
-    }
-    cbfunc := reflect.ValueOf(callback)
-    this.subcommands[command] = SubcommandArgumentData{parser: parser,
-                                                callback: cbfunc}
-    this.choices = append(this.choices, command)
-    return parser, nil
+/*
+clear the value, e.g. before a value of higher precedence is set
+*/
+func (this *SingleArgument) reset() {
+    this.value.Set(reflect.Zero(this.value.Type()))
+    this.isSet = false
+    this.source = ArgumentSource{}
+}
+
+func (this *SingleArgument) ValueString() string {
+    value := this.value
+    if value.Kind() == reflect.Ptr {
+        if value.IsNil() {
+            return ""
+        }
+        value = value.Elem()
+    }
+    return fmt.Sprintf("%v", value.Interface())
+}
+
+func (this *MultiArgument) IsMulti() bool {
+    return true
+}
+
+func (this *MultiArgument) reset() {
+    this.SingleArgument.reset()
+    this.count = 0
+}
+
+func (this *MultiArgument) IsNumeric() bool {
+    return gotypes.IsNumericType(this.value.Type().Elem())
+}
+
+/*
+number of values set, a fixed-size array is filled from the first element
+*/
+func (this *MultiArgument) valueCount() int {
+    if this.value.Kind() == reflect.Array {
+        return this.count
+    }
+    return this.value.Len()
+}
+
+/*
+split a list value by a separator, e.g. "a, b,c" by ",", empty elements
+are dropped
+*/
+func splitValues(val string, sep string) []string {
+    vals := make([]string, 0)
+    for _, v := range strings.Split(val, sep) {
+        v = strings.TrimSpace(v)
+        if len(v) > 0 {
+            vals = append(vals, v)
+        }
+    }
+    return vals
+}
+
+/*
+append a value to the argument, the value is split first if the argument
+has a separator
+*/
+func (this *MultiArgument) SetValue(val string) error {
+    if len(this.sep) == 0 {
+        return this.appendValue(val)
+    }
+    for _, v := range splitValues(val, this.sep) {
+        e := this.appendValue(v)
+        if e != nil {
+            return e
+        }
+    }
+    return nil
+}
+
+func (this *MultiArgument) appendValue(val string) error {
+    if ! this.InChoices(val)  {
+        return this.choiceError(val)
+    }
+    var e error = nil
+    if this.value.Kind() == reflect.Array {
+        if this.count >= this.value.Len() {
+            return fmt.Errorf("Too many values for %s, at most %d", this.Token(), this.value.Len())
+        }
+        var elem reflect.Value
+        elem, e = gotypes.ParseValue(val, this.value.Type().Elem())
+        if e != nil {
+            return e
+        }
+        this.value.Index(this.count).Set(elem)
+        this.count += 1
+    }else {
+        e = gotypes.AppendValue(this.value, val)
+        if e != nil {
+            return e
+        }
+    }
+    this.isSet = true
+    return nil
+}
+
+/*
+The number of values is checked in total for a positional argument, and
+for each occurrence of an optional argument while parsing
+*/
+func (this *MultiArgument) Validate() error {
+    var e = this.SingleArgument.Validate()
+    if e != nil {
+        return e
+    }
+    if ! this.IsPositional() || (! this.isSet && this.IsOptional()) {
+        return nil
+    }
+    var vallen int64 = int64(this.valueCount())
+    if (this.minCount >= 0 && vallen < this.minCount) {
+        return fmt.Errorf("Argument count requires at least %d", this.minCount)
+    }
+    if (this.maxCount >= 0 && vallen > this.maxCount) {
+        return fmt.Errorf("Argument count requires at most %d", this.maxCount)
+    }
+    return nil
+}
+
+/*
+split a key=value pair
+*/
+func splitKeyValue(str string) (string, string, error) {
+    pos := strings.IndexByte(str, '=')
+    if pos <= 0 {
+        return "", "", fmt.Errorf("Invalid key=value pair \"%s\"", str)
+    }
+    return strings.TrimSpace(str[:pos]), strings.TrimSpace(str[pos+1:]), nil
+}
+
+/*
+set key=value pairs of a map value, the pairs are split by the separator
+if any
+*/
+func setMapValues(value reflect.Value, val string, sep string, override bool) error {
+    pairs := []string{val}
+    if len(sep) > 0 {
+        pairs = splitValues(val, sep)
+    }
+    for _, pair := range pairs {
+        k, v, e := splitKeyValue(pair)
+        if e != nil {
+            return e
+        }
+        if ! override && ! value.IsNil() {
+            key, e := gotypes.ParseValue(k, value.Type().Key())
+            if e != nil {
+                return e
+            }
+            if value.MapIndex(key).IsValid() {
+                return fmt.Errorf("Duplicate key %s", k)
+            }
+        }
+        e = gotypes.SetMapValue(value, k, v)
+        if e != nil {
+            return e
+        }
+    }
+    return nil
+}
+
+func (this *MapArgument) SetValue(val string) error {
+    e := setMapValues(this.value, val, this.sep, this.override)
+    if e != nil {
+        return fmt.Errorf("%s: %s", this.Token(), e)
+    }
+    this.isSet = true
+    return nil
+}
+
+/*
+a default map is copied, so that the default is not changed by values
+set afterwards
+*/
+func (this *MapArgument) Validate() error {
+    if ! this.isSet {
+        e := this.resolveDefault()
+        if e != nil {
+            return e
+        }
+    }
+    if ! this.isSet && this.useDefault {
+        value := reflect.MakeMap(this.value.Type())
+        for _, key := range this.defValue.MapKeys() {
+            value.SetMapIndex(key, this.defValue.MapIndex(key))
+        }
+        this.value.Set(value)
+        this.source = this.defSource
+        return nil
+    }
+    return this.SingleArgument.Validate()
+}
+
+func (this *SubcommandArgument) IsSubcommand() bool {
+    return true
+}
+
+func (this *SubcommandArgument) SetValue(val string) error {
+    if ! this.InChoices(val) {
+        return fmt.Errorf("Unknown subcommand \"%s\"%s", val, didYouMean(val, this.choices, "\""))
+    }
+    return this.SingleArgument.SetValue(val)
+}
+
+func (this *SubcommandArgument) String() string {
+    return fmt.Sprintf("<%s>", strings.ToUpper(this.token))
+}
+
+func (this *SubcommandArgument) AddSubParser(target interface{}, command string, desc string, callback interface{}) (*ArgumentParser, error) {
+    prog := fmt.Sprintf("%s %s", this.parser.prog, command)
+    parser, e := NewArgumentParser(target, prog, desc, "")
+    if e != nil {
+        return nil, e
+    }
+    parser.abbrevMode = this.parser.abbrevMode
+    parser.unknownKeyMode = this.parser.unknownKeyMode
+    parser.logger = this.parser.logger
+    parser.envPrefix = this.parser.envPrefix
+    parser.setEnvVars(this.parser.envVars)
+    cbfunc := reflect.ValueOf(callback)
+    this.subcommands[command] = SubcommandArgumentData{parser: parser,
+                                                callback: cbfunc}
+    this.choices = append(this.choices, command)
+    return parser, nil
 }
 
 func (this *SubcommandArgument) HelpString(indent string) string {
@@ -502,6 +1368,17 @@ func (this *SubcommandArgument) SubHelpString(cmd string) (string, error) {
     }
 }
 
+/*
+the sub-parser of a subcommand, nil if there is no such subcommand
+*/
+func (this *SubcommandArgument) subParser(cmd string) *ArgumentParser {
+    val, ok := this.subcommands[cmd]
+    if ok {
+        return val.parser
+    }
+    return nil
+}
+
 func (this *SubcommandArgument) GetSubParser() *ArgumentParser {
     var cmd = this.value.String()
     val, ok := this.subcommands[cmd]
@@ -558,6 +1435,27 @@ func (this *ArgumentParser) Usage() string {
     return buf.String()
 }
 
+/*
+the help of an argument, followed by its environment variable
+*/
+func (this *ArgumentParser) writeArgumentHelp(buf *bytes.Buffer, arg Argument) {
+    buf.WriteString("    ")
+    buf.WriteString(arg.String())
+    buf.WriteByte('\n')
+    buf.WriteString(arg.HelpString("        "))
+    env := this.envName(arg)
+    if len(env) > 0 {
+        buf.WriteString(" [env: ")
+        buf.WriteString(env)
+        if arg.IsSecret() {
+            buf.WriteString(", ")
+            buf.WriteString(env + SECRET_FILE_SUFFIX)
+        }
+        buf.WriteString("]")
+    }
+    buf.WriteByte('\n')
+}
+
 func (this *ArgumentParser) HelpString() string {
     var buf bytes.Buffer
     buf.WriteString(this.Usage())
@@ -567,22 +1465,14 @@ func (this *ArgumentParser) HelpString() string {
     if len(this.posArgs) > 0 {
         buf.WriteString("Positional arguments:\n")
         for _, arg := range this.posArgs {
-            buf.WriteString("    ")
-            buf.WriteString(arg.String())
-            buf.WriteByte('\n')
-            buf.WriteString(arg.HelpString("        "))
-            buf.WriteByte('\n')
+            this.writeArgumentHelp(&buf, arg)
         }
         buf.WriteByte('\n')
     }
     if len(this.optArgs) > 0 {
         buf.WriteString("Optional arguments:\n")
         for _, arg := range this.optArgs {
-            buf.WriteString("    ")
-            buf.WriteString(arg.String())
-            buf.WriteByte('\n')
-            buf.WriteString(arg.HelpString("        "))
-            buf.WriteByte('\n')
+            this.writeArgumentHelp(&buf, arg)
         }
         buf.WriteByte('\n')
     }
@@ -594,18 +1484,529 @@ func (this *ArgumentParser) HelpString() string {
     return buf.String()
 }
 
-func (this *ArgumentParser) findOptionalArgument(token string) Argument {
+/*
+a long token of an optional argument, a negated token is the "no-" form
+of a boolean argument, e.g. --no-cache
+*/
+type optionalName struct {
+    name string
+    arg Argument
+    negated bool
+}
+
+func (this *ArgumentParser) optionalNames() []optionalName {
+    names := make([]optionalName, 0)
+    for _, arg := range this.optArgs {
+        names = append(names, optionalName{name: arg.Token(), arg: arg})
+        if arg.IsNegatable() {
+            names = append(names, optionalName{name: "no-" + arg.Token(), arg: arg, negated: true})
+        }
+    }
+    return names
+}
+
+/*
+find the optional argument of a token and whether the token is negated.
+An exact long token or short token match always wins, otherwise a unique
+prefix of a long token is accepted according to the abbreviation mode of
+the parser. An ambiguous prefix is an error.
+*/
+func (this *ArgumentParser) findOptionalArgument(token string) (Argument, bool, error) {
+    names := this.optionalNames()
+    for _, n := range names {
+        if n.name == token {
+            return n.arg, n.negated, nil
+        }
+    }
+    arg := this.findShortArgument(token)
+    if arg != nil || this.abbrevMode == ABBREV_OFF {
+        return arg, false, nil
+    }
+    matches := make([]optionalName, 0)
+    for _, n := range names {
+        if strings.HasPrefix(n.name, token) {
+            matches = append(matches, n)
+        }
+    }
+    if len(matches) == 0 {
+        return nil, false, nil
+    }else if len(matches) > 1 {
+        candidates := make([]string, len(matches))
+        for i, n := range matches {
+            candidates[i] = "--" + n.name
+        }
+        return nil, false, fmt.Errorf("Ambiguous option --%s could match %s", token, strings.Join(candidates, ", "))
+    }
+    if this.abbrevMode == ABBREV_WARN {
+        this.logf("Option --%s is an abbreviation of --%s", token, matches[0].name)
+    }
+    return matches[0].arg, matches[0].negated, nil
+}
+
+/*
+set how optional arguments may be abbreviated, the mode also applies
+to the parsers of subcommands
+*/
+func (this *ArgumentParser) SetAbbrevMode(mode AbbrevMode) {
+    this.abbrevMode = mode
+    subcmd := this.GetSubcommand()
+    if subcmd != nil {
+        for _, data := range subcmd.subcommands {
+            data.parser.SetAbbrevMode(mode)
+        }
+    }
+}
+
+/*
+set how unknown keys of configuration files are handled, the mode also
+applies to the parsers of subcommands
+*/
+func (this *ArgumentParser) SetUnknownKeyMode(mode UnknownKeyMode) {
+    this.unknownKeyMode = mode
+    subcmd := this.GetSubcommand()
+    if subcmd != nil {
+        for _, data := range subcmd.subcommands {
+            data.parser.SetUnknownKeyMode(mode)
+        }
+    }
+}
+
+/*
+set the prefix of the environment variables bound to optional arguments,
+e.g. with the prefix CLIMC_, --auth-url is bound to CLIMC_AUTH_URL. The
+prefix also applies to the parsers of subcommands
+*/
+func (this *ArgumentParser) SetEnvPrefix(prefix string) {
+    this.envPrefix = prefix
+    subcmd := this.GetSubcommand()
+    if subcmd != nil {
+        for _, data := range subcmd.subcommands {
+            data.parser.SetEnvPrefix(prefix)
+        }
+    }
+}
+
+/*
+the environment variable bound to an argument, given by the env tag or
+by the env prefix of the parser for a --token argument that takes a
+value or is a boolean flag, a positional argument is bound only by the
+env tag. Empty if the argument is not bound.
+*/
+func (this *ArgumentParser) envName(arg Argument) string {
+    env := arg.Env()
+    if env == "-" || arg.IsSubcommand() {
+        return ""
+    }
+    if len(env) > 0 {
+        return env
+    }
+    if len(this.envPrefix) == 0 || arg.IsPositional() || ! arg.IsOptional() || ! (arg.NeedData() || arg.IsNegatable()) {
+        return ""
+    }
+    return this.envPrefix + strings.ToUpper(strings.Replace(arg.Token(), "-", "_", -1))
+}
+
+/*
+the value of an environment variable, a variable of the process
+environment overrides a variable loaded by LoadEnvFile
+*/
+func (this *ArgumentParser) lookupEnv(name string) (string, bool) {
+    val, found := os.LookupEnv(name)
+    if ! found {
+        val, found = this.envVars[name]
+    }
+    return val, found
+}
+
+/*
+set the arguments bound to environment variables, an empty variable is
+ignored. The values are parsed like command-line values. A secret
+argument whose variable NAME is empty is read from the file NAME_FILE.
+*/
+func (this *ArgumentParser) applyEnv() error {
+    args := make([]Argument, 0, len(this.posArgs) + len(this.optArgs))
+    args = append(args, this.posArgs...)
+    for _, arg := range append(args, this.optArgs...) {
+        name := this.envName(arg)
+        if len(name) == 0 {
+            continue
+        }
+        val, _ := this.lookupEnv(name)
+        if len(val) == 0 && arg.IsSecret() {
+            path, _ := this.lookupEnv(name + SECRET_FILE_SUFFIX)
+            if len(path) > 0 {
+                // read like a value @path
+                name += SECRET_FILE_SUFFIX
+                val = "@" + path
+            }
+        }
+        if len(val) == 0 {
+            continue
+        }
+        if arg.Source().Kind == SOURCE_ENV {
+            // parsed again, e.g. a slice must not be appended twice
+            resetArgument(arg)
+        }
+        e := this.setArgumentValue(arg, val, ArgumentSource{Kind: SOURCE_ENV, EnvVar: name})
+        if e != nil {
+            return fmt.Errorf("Invalid value of env %s: %s", name, e)
+        }
+    }
+    return nil
+}
+
+/*
+set the logger of warnings, nil disables warnings. The logger also
+applies to the parsers of subcommands
+*/
+func (this *ArgumentParser) SetLogger(logger Logger) {
+    this.logger = logger
+    subcmd := this.GetSubcommand()
+    if subcmd != nil {
+        for _, data := range subcmd.subcommands {
+            data.parser.SetLogger(logger)
+        }
+    }
+}
+
+func (this *ArgumentParser) logf(format string, v ...interface{}) {
+    if this.logger != nil {
+        this.logger.Printf(format, v...)
+    }
+}
+
+/*
+handle an unknown key or section of a configuration file according to
+the unknown key mode
+*/
+func (this *ArgumentParser) unknownKey(e error) error {
+    switch this.unknownKeyMode {
+        case UNKNOWN_KEY_STRICT:
+            return e
+        case UNKNOWN_KEY_WARN:
+            this.logf("%s", e)
+    }
+    return nil
+}
+
+/*
+split an optional argument of the form --token=value into token and value
+*/
+func splitOptionalArgument(str string) (string, string, bool) {
+    pos := strings.IndexByte(str, '=')
+    if pos > 0 {
+        return str[:pos], str[pos+1:], true
+    }else {
+        return str, "", false
+    }
+}
+
+/*
+find an optional argument whose short token is followed immediately by
+its value, e.g. -t600
+*/
+func (this *ArgumentParser) findAttachedShortArgument(token string) (Argument, string, bool) {
     var match_arg Argument = nil
     for _, arg := range this.optArgs {
-        if strings.HasPrefix(arg.Token(), token) || strings.HasPrefix(arg.ShortToken(), token) {
-            if match_arg != nil {
-                return nil
-            }else {
+        short := arg.ShortToken()
+        if len(short) > 0 && len(short) < len(token) && strings.HasPrefix(token, short) && arg.NeedData() {
+            if match_arg == nil || len(short) > len(match_arg.ShortToken()) {
                 match_arg = arg
             }
         }
     }
-    return match_arg
+    if match_arg != nil {
+        return match_arg, token[len(match_arg.ShortToken()):], true
+    }
+    return nil, "", false
+}
+
+/*
+all command-line tokens of the optional arguments, e.g. --timeout and -t
+*/
+func (this *ArgumentParser) optionalTokens() []string {
+    tokens := make([]string, 0)
+    for _, n := range this.optionalNames() {
+        tokens = append(tokens, "--" + n.name)
+    }
+    for _, arg := range this.optArgs {
+        if len(arg.ShortToken()) > 0 {
+            tokens = append(tokens, "-" + arg.ShortToken())
+        }
+    }
+    return tokens
+}
+
+func (this *ArgumentParser) findShortArgument(token string) Argument {
+    for _, arg := range this.optArgs {
+        if len(arg.ShortToken()) > 0 && arg.ShortToken() == token {
+            return arg
+        }
+    }
+    return nil
+}
+
+/*
+an optional argument matched from a command-line token, with the value
+attached to the token if any
+*/
+type optionalMatch struct {
+    arg Argument
+    value string
+    hasValue bool
+}
+
+/*
+match a command-line token starting with "-" to optional arguments.
+A token starting with "--" is a long token, optionally followed by
+"=value". A token starting with a single "-" is, in order of preference,
+an exact short token, a cluster of single-character short tokens, e.g.
+-vdx, a short token with attached value, e.g. -t600, or a long token.
+Only the last matched argument may still need a value from the next
+command-line argument. Returns nil if the token matches no argument.
+*/
+func (this *ArgumentParser) matchOptionalArguments(str string) ([]optionalMatch, error) {
+    if strings.HasPrefix(str, "--") {
+        token, value, has_value := splitOptionalArgument(str[2:])
+        return this.matchLongArgument(token, value, has_value)
+    }
+    token, value, has_value := splitOptionalArgument(str[1:])
+    if len(token) == 0 {
+        return nil, nil
+    }
+    arg := this.findShortArgument(token)
+    if arg != nil {
+        return []optionalMatch{{arg: arg, value: value, hasValue: has_value}}, nil
+    }
+    if this.findShortArgument(str[1:2]) != nil {
+        return this.matchShortCluster(str[1:])
+    }
+    if ! has_value {
+        arg, value, has_value = this.findAttachedShortArgument(token)
+        if arg != nil {
+            return []optionalMatch{{arg: arg, value: value, hasValue: has_value}}, nil
+        }
+    }
+    return this.matchLongArgument(token, value, has_value)
+}
+
+/*
+match a long token, a negated token sets the value false
+*/
+func (this *ArgumentParser) matchLongArgument(token string, value string, has_value bool) ([]optionalMatch, error) {
+    arg, negated, e := this.findOptionalArgument(token)
+    if arg == nil {
+        return nil, e
+    }
+    if negated {
+        if has_value {
+            return nil, fmt.Errorf("Option --no-%s does not take a value", arg.Token())
+        }
+        return []optionalMatch{{arg: arg, value: "false", hasValue: true}}, nil
+    }
+    return []optionalMatch{{arg: arg, value: value, hasValue: has_value}}, nil
+}
+
+/*
+match a cluster of single-character short tokens, e.g. -vdx.
+An argument which needs data takes the rest of the cluster as its value,
+e.g. -vt600, or the next command-line argument if it is the last one.
+*/
+func (this *ArgumentParser) matchShortCluster(cluster string) ([]optionalMatch, error) {
+    matches := make([]optionalMatch, 0)
+    for i := 0; i < len(cluster); i ++ {
+        arg := this.findShortArgument(cluster[i:i+1])
+        if arg == nil {
+            return nil, nil
+        }
+        rest := cluster[i+1:]
+        if strings.HasPrefix(rest, "=") {
+            return append(matches, optionalMatch{arg: arg, value: rest[1:], hasValue: true}), nil
+        }
+        if arg.NeedData() {
+            if len(rest) == 0 {
+                return append(matches, optionalMatch{arg: arg}), nil
+            }
+            if this.isShortCluster(rest) {
+                return nil, fmt.Errorf("Option -%c in -%s requires a value, it must be the last option of the cluster or be given as -%c=VALUE", cluster[i], cluster, cluster[i])
+            }
+            return append(matches, optionalMatch{arg: arg, value: rest, hasValue: true}), nil
+        }
+        matches = append(matches, optionalMatch{arg: arg})
+    }
+    return matches, nil
+}
+
+func (this *ArgumentParser) isShortCluster(str string) bool {
+    for i := 0; i < len(str); i ++ {
+        if this.findShortArgument(str[i:i+1]) == nil {
+            return false
+        }
+    }
+    return true
+}
+
+func isNegativeNumber(str string) bool {
+    if ! strings.HasPrefix(str, "-") {
+        return false
+    }
+    _, e := strconv.ParseFloat(str, 64)
+    return e == nil
+}
+
+func (this *ArgumentParser) hasNumericShortToken() bool {
+    for _, arg := range this.optArgs {
+        if isNegativeNumber("-" + arg.ShortToken()) {
+            return true
+        }
+    }
+    return false
+}
+
+/*
+the positional argument that will receive the next positional value
+*/
+func (this *ArgumentParser) nextPositionalArgument(pos_idx int) Argument {
+    if pos_idx < len(this.posArgs) {
+        return this.posArgs[pos_idx]
+    }else if len(this.posArgs) > 0 && this.posArgs[len(this.posArgs)-1].IsMulti() {
+        return this.posArgs[len(this.posArgs)-1]
+    }
+    return nil
+}
+
+/*
+whether a command-line argument should be parsed as an optional argument.
+A single "-" is a positional value. A negative number, e.g. -5 or -3.14,
+is a positional value if no short token looks like a number and the next
+positional argument is numeric.
+*/
+func (this *ArgumentParser) isOptionalToken(str string, pos_idx int) bool {
+    if ! strings.HasPrefix(str, "-") || len(str) == 1 {
+        return false
+    }
+    if isNegativeNumber(str) && ! this.hasNumericShortToken() {
+        arg := this.nextPositionalArgument(pos_idx)
+        if arg != nil && arg.IsNumeric() {
+            return false
+        }
+    }
+    return true
+}
+
+/*
+whether a command-line argument can be the value of an optional argument
+*/
+func (this *ArgumentParser) isOptionValue(str string, arg Argument) bool {
+    if str == "--" {
+        return false
+    }
+    if ! strings.HasPrefix(str, "-") || len(str) == 1 {
+        return true
+    }
+    return isNegativeNumber(str) && ! this.hasNumericShortToken() && arg.IsNumeric()
+}
+
+/*
+consume values of an optional multi argument greedily from the following
+command-line arguments, up to the maximal count of its nargs. Returns the
+number of command-line arguments consumed.
+*/
+func (this *ArgumentParser) parseMultiValues(arg *MultiArgument, token string, args []string) (int, error) {
+    var count int64 = 0
+    for _, val := range args {
+        if arg.maxCount >= 0 && count >= arg.maxCount {
+            break
+        }
+        if ! this.isOptionValue(val, arg) {
+            break
+        }
+        err := this.setArgumentValue(arg, val, ArgumentSource{Kind: SOURCE_CLI})
+        if err != nil {
+            return int(count), err
+        }
+        count += 1
+    }
+    if count < arg.minCount {
+        return int(count), fmt.Errorf("Missing arguments for %s, requires at least %d", token, arg.minCount)
+    }
+    return int(count), nil
+}
+
+/*
+whether a value from a source may be set to an argument. A value never
+overrides a value from a source of higher precedence, and the value
+from a source of lower precedence, another file or another profile is
+cleared first.
+*/
+func (this *ArgumentParser) acceptSource(arg Argument, src ArgumentSource) bool {
+    cur := arg.Source()
+    if cur.Kind > src.Kind {
+        return false
+    }
+    if cur.Kind < src.Kind && cur.Kind != SOURCE_NONE {
+        resetArgument(arg)
+    }else if cur.Kind == SOURCE_FILE && (cur.File != src.File || cur.Profile != src.Profile) {
+        // a later file or a profile overlays the value
+        resetArgument(arg)
+    }
+    return true
+}
+
+/*
+the value of a secret: @path is the content of the file path with
+trailing newlines trimmed, @@ escapes a value starting with @
+*/
+func readSecretValue(val string) (string, error) {
+    if strings.HasPrefix(val, "@@") {
+        return val[1:], nil
+    }
+    if ! strings.HasPrefix(val, "@") {
+        return val, nil
+    }
+    content, e := ioutil.ReadFile(val[1:])
+    if e != nil {
+        return "", e
+    }
+    return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+/*
+set the value of an argument and record its source. The value of a
+secret is never part of an error.
+*/
+func (this *ArgumentParser) setArgumentValue(arg Argument, val string, src ArgumentSource) error {
+    if ! this.acceptSource(arg, src) {
+        return nil
+    }
+    if arg.IsSecret() {
+        var e error
+        val, e = readSecretValue(val)
+        if e != nil {
+            return fmt.Errorf("Cannot read secret of %s: %s", arg.Token(), e)
+        }
+    }
+    err := arg.SetValue(val)
+    if err != nil {
+        if arg.IsSecret() {
+            return fmt.Errorf("Invalid secret value of %s", arg.Token())
+        }
+        return err
+    }
+    setArgumentSource(arg, src)
+    return nil
+}
+
+func (this *ArgumentParser) doArgumentAction(arg Argument, src ArgumentSource) error {
+    if ! this.acceptSource(arg, src) {
+        return nil
+    }
+    err := arg.DoAction()
+    if err != nil {
+        return err
+    }
+    setArgumentSource(arg, src)
+    return nil
 }
 
 func validateArgs(args []Argument) error {
@@ -632,55 +2033,116 @@ func (this *ArgumentParser) Validate() error {
 }
 
 func (this *ArgumentParser) ParseArgs(args []string, ignore_unknown bool) error {
+    return this.parseArgs(args, ignore_unknown, nil)
+}
+
+/*
+parse command-line arguments, unknown arguments are collected in leftovers
+in their original order if leftovers is not nil
+*/
+func (this *ArgumentParser) parseArgs(args []string, ignore_unknown bool, leftovers *[]string) error {
     var pos_idx int = 0
     var arg Argument = nil
+    var matches []optionalMatch = nil
     var err error = nil
+    var end_of_options bool = false
+    var leftover_end_of_options bool = false
+    err = this.applyEnv()
+    if err != nil {
+        return err
+    }
+    err = this.loadEnvFile(args)
+    if err != nil {
+        return err
+    }
+    err = this.loadConfigFile(args)
+    if err != nil {
+        return err
+    }
     for i := 0; i < len(args); i ++ {
-        if strings.HasPrefix(args[i], "-") {
-            arg = this.findOptionalArgument(strings.TrimLeft(args[i], "-"))
-            if arg != nil {
-                if arg.NeedData() {
+        if ! end_of_options && args[i] == "--" {
+            end_of_options = true
+            continue
+        }
+        if ! end_of_options && this.isOptionalToken(args[i], pos_idx) {
+            matches, err = this.matchOptionalArguments(args[i])
+            if err != nil {
+                return err
+            }
+            if matches == nil {
+                if ! ignore_unknown {
+                    token, _, _ := splitOptionalArgument(args[i])
+                    return fmt.Errorf("Unknown optional argument %s%s", args[i], didYouMean(token, this.optionalTokens(), ""))
+                }
+                if leftovers != nil {
+                    *leftovers = append(*leftovers, args[i])
+                    // the next argument is the value of the unknown option
+                    // if no positional argument could take it
+                    _, _, has_value := splitOptionalArgument(args[i])
+                    if ! has_value && i + 1 < len(args) && args[i+1] != "--" &&
+                            ! this.isOptionalToken(args[i+1], pos_idx) &&
+                            this.nextPositionalArgument(pos_idx) == nil {
+                        *leftovers = append(*leftovers, args[i+1])
+                        i ++
+                    }
+                }
+                continue
+            }
+            for _, m := range matches {
+                if m.hasValue {
+                    err = this.setArgumentValue(m.arg, m.value, ArgumentSource{Kind: SOURCE_CLI})
+                }else if m.arg.IsMulti() && m.arg.NeedData() {
+                    var consumed int
+                    consumed, err = this.parseMultiValues(m.arg.(*MultiArgument), args[i], args[i+1:])
+                    i += consumed
+                }else if m.arg.NeedData() {
                     if i + 1 < len(args) {
-                        err = arg.SetValue(args[i+1])
-                        if err != nil {
-                            return err
-                        }
+                        err = this.setArgumentValue(m.arg, args[i+1], ArgumentSource{Kind: SOURCE_CLI})
                         i ++
                     }else {
                         return fmt.Errorf("Missing arguments for %s", args[i])
                     }
                 }else {
-                    err = arg.DoAction()
-                    if err != nil {
-                        return err
-                    }
+                    err = this.doArgumentAction(m.arg, ArgumentSource{Kind: SOURCE_CLI})
+                }
+                if err != nil {
+                    return err
                 }
-            }else if ! ignore_unknown {
-                return fmt.Errorf("Unknown optional argument %s", args[i])
             }
         }else {
             if pos_idx >= len(this.posArgs) {
-                if len(this.posArgs) > 0 {
-                    last_arg := this.posArgs[len(this.posArgs)-1]
-                    if last_arg.IsMulti() {
-                        last_arg.SetValue(args[i])
-                    } else if ! ignore_unknown {
-                        return fmt.Errorf("Unknown positional argument %s", args[i])
+                if len(this.posArgs) > 0 && this.posArgs[len(this.posArgs)-1].IsMulti() {
+                    err = this.setArgumentValue(this.posArgs[len(this.posArgs)-1], args[i], ArgumentSource{Kind: SOURCE_CLI})
+                    if err != nil {
+                        return err
                     }
-                } else if ! ignore_unknown {
+                }else if ! ignore_unknown {
                     return fmt.Errorf("Unknown positional argument %s", args[i])
+                }else if leftovers != nil {
+                    if end_of_options && ! leftover_end_of_options {
+                        *leftovers = append(*leftovers, "--")
+                        leftover_end_of_options = true
+                    }
+                    *leftovers = append(*leftovers, args[i])
                 }
             }else {
                 arg = this.posArgs[pos_idx]
                 pos_idx += 1
-                err = arg.SetValue(args[i])
+                err = this.setArgumentValue(arg, args[i], ArgumentSource{Kind: SOURCE_CLI})
                 if err != nil {
                     return err
                 }
                 if arg.IsSubcommand() {
                     var subarg *SubcommandArgument = arg.(*SubcommandArgument)
                     var subparser = subarg.GetSubParser()
-                    err = subparser.ParseArgs(args[i+1:], ignore_unknown)
+                    if subparser == nil {
+                        return fmt.Errorf("Unknown subcommand \"%s\"%s", args[i], didYouMean(args[i], subarg.choices, "\""))
+                    }
+                    var subargs = args[i+1:]
+                    if end_of_options {
+                        subargs = append([]string{"--"}, subargs...)
+                    }
+                    err = subparser.parseArgs(subargs, ignore_unknown, leftovers)
                     if err != nil {
                         return err
                     }
@@ -695,41 +2157,71 @@ func (this *ArgumentParser) ParseArgs(args []string, ignore_unknown bool) error
     return this.Validate()
 }
 
-func (this *ArgumentParser) parseKeyValue(key, value string) error {
-    arg := this.findOptionalArgument(key)
-    if arg != nil {
-        return arg.SetValue(value)
-    } else {
-        log.Printf("Cannot found argument %s", key)
+/*
+scan the command-line arguments for the value of an optional argument
+without parsing them, the scan stops at "--" and at a subcommand
+*/
+func (this *ArgumentParser) scanArgument(args []string, target Argument) (string, bool) {
+    var value string
+    var found bool = false
+    var subcmd = this.GetSubcommand()
+    for i := 0; i < len(args); i ++ {
+        if args[i] == "--" {
+            break
+        }
+        if ! this.isOptionalToken(args[i], 0) {
+            if subcmd != nil && subcmd.InChoices(args[i]) {
+                break
+            }
+            continue
+        }
+        matches, err := this.matchOptionalArguments(args[i])
+        if err != nil || len(matches) == 0 {
+            continue
+        }
+        m := matches[len(matches)-1]
+        var val string
+        if m.hasValue {
+            val = m.value
+        }else if m.arg.NeedData() && ! m.arg.IsMulti() && i + 1 < len(args) {
+            val = args[i+1]
+            i ++
+        }
+        if m.arg == target {
+            value = val
+            found = true
+        }
     }
-    return nil
+    return value, found
 }
 
-func (this *ArgumentParser) ParseFile(filepath string) error {
-    file, e := os.Open(filepath)
-    if e != nil {
-        return e
+/*
+the path of the file of a built-in argument, e.g. the config argument,
+given on the command line, by an environment variable or by its default
+if the file exists. Empty if there is no file.
+*/
+func (this *ArgumentParser) builtinFilePath(arg *SingleArgument, args []string) (string, error) {
+    if arg == nil {
+        return "", nil
     }
-    defer file.Close()
-
-    scanner := bufio.NewScanner(file)
-    for scanner.Scan() {
-        line := scanner.Text()
-        pos := strings.IndexByte(line, '=')
-        if pos > 0 && pos < len(line) {
-            key := strings.Replace(strings.Trim(line[:pos], " "), "_", "-", -1)
-            val := strings.Trim(line[pos+1:], " ")
-            this.parseKeyValue(key, val)
-        } else {
-            return fmt.Errorf("Misformated line: %s", line)
-        }
+    path, found := this.scanArgument(args, arg)
+    if ! found && arg.Source().Kind == SOURCE_ENV {
+        path, found = arg.ValueString(), true
     }
-
-    if err := scanner.Err(); err != nil {
-        return err
+    if ! found {
+        e := arg.resolveDefault()
+        if e != nil {
+            return "", e
+        }
+        if ! arg.useDefault {
+            return "", nil
+        }
+        path = arg.defValue.String()
+        if _, e := os.Stat(path); e != nil {
+            return "", nil
+        }
     }
-
-    return nil
+    return path, nil
 }
 
 func (this *ArgumentParser) GetSubcommand() *SubcommandArgument {
@@ -742,6 +2234,99 @@ func (this *ArgumentParser) GetSubcommand() *SubcommandArgument {
     return nil
 }
 
+/*
+find an argument by its long token, or by the metavar of a positional
+argument
+*/
+func (this *ArgumentParser) findArgument(token string) Argument {
+    for _, arg := range this.optArgs {
+        if arg.Token() == token {
+            return arg
+        }
+    }
+    for _, arg := range this.posArgs {
+        if arg.Token() == token || arg.MetaVar() == token {
+            return arg
+        }
+    }
+    return nil
+}
+
+/*
+whether the value of an argument is given on the command line, in a
+configuration file or by an environment variable
+*/
+func (this *ArgumentParser) IsSet(token string) bool {
+    arg := this.findArgument(token)
+    return arg != nil && arg.IsSet()
+}
+
+/*
+the source of the value of an argument, returns false if there is no
+such argument
+*/
+func (this *ArgumentParser) Source(token string) (ArgumentSource, bool) {
+    arg := this.findArgument(token)
+    if arg == nil {
+        return ArgumentSource{}, false
+    }
+    return arg.Source(), true
+}
+
+func writeConfigArgs(buf *bytes.Buffer, args []Argument) {
+    for _, arg := range args {
+        if arg.IsSubcommand() {
+            continue
+        }
+        buf.WriteString(arg.Token())
+        buf.WriteString(" = ")
+        if arg.IsSecret() && len(arg.ValueString()) > 0 {
+            buf.WriteString(SECRET_REDACTED)
+        }else {
+            buf.WriteString(arg.ValueString())
+        }
+        buf.WriteString(" (")
+        buf.WriteString(arg.Source().String())
+        buf.WriteString(")\n")
+    }
+}
+
+/*
+the effective configuration, i.e. the value and the source of each
+argument, followed by the configuration of the selected subcommand,
+e.g. for a --show-config flag
+*/
+func (this *ArgumentParser) ConfigString() string {
+    var buf bytes.Buffer
+    writeConfigArgs(&buf, this.posArgs)
+    writeConfigArgs(&buf, this.optArgs)
+    subcmd := this.GetSubcommand()
+    if subcmd != nil {
+        subparser := subcmd.GetSubParser()
+        if subparser != nil {
+            buf.WriteString("\n[")
+            buf.WriteString(subcmd.ValueString())
+            buf.WriteString("]\n")
+            buf.WriteString(subparser.ConfigString())
+        }
+    }
+    return buf.String()
+}
+
 func (this *ArgumentParser) ParseKnownArgs(args []string) error {
     return this.ParseArgs(args, true)
 }
+
+/*
+parse the known arguments and return the unknown ones in their original
+order, e.g. to forward them to a child process. An unknown option keeps
+its value next to it if no positional argument could take the value.
+*/
+func (this *ArgumentParser) ParseKnownArgsWithLeftovers(args []string) ([]string, error) {
+    leftovers := make([]string, 0)
+    err := this.parseArgs(args, true, &leftovers)
+    if err != nil {
+        return nil, err
+    }
+    return leftovers, nil
+}
@@ -0,0 +1,1484 @@
+package structarg
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "testing"
+    "time"
+    "reflect"
+    "path/filepath"
+)
+
+type testOptions struct {
+    Help bool       `help:"Show help" short-token:"h"`
+    Debug bool      `help:"Show debug information" short-token:"d"`
+    Timeout int     `default:"600" help:"Timeout" short-token:"t"`
+    Region string   `help:"Region" choices:"east|west"`
+}
+
+func newTestParser(t *testing.T) (*ArgumentParser, *testOptions) {
+    options := &testOptions{}
+    parser, e := NewArgumentParser(options, "test", "test prog", "")
+    if e != nil {
+        t.Fatalf("NewArgumentParser error %s", e)
+    }
+    return parser, options
+}
+
+func TestParseArgsAttachedValue(t *testing.T) {
+    cases := []struct {
+        args []string
+        timeout int
+        debug bool
+        region string
+    } {
+        {[]string{"--timeout=30"}, 30, false, ""},
+        {[]string{"--timeout", "30"}, 30, false, ""},
+        {[]string{"-t30"}, 30, false, ""},
+        {[]string{"-t=30"}, 30, false, ""},
+        {[]string{"--debug=true"}, 600, true, ""},
+        {[]string{"--debug", "--debug=false"}, 600, false, ""},
+        {[]string{"--region=west"}, 600, false, "west"},
+    }
+    for _, c := range cases {
+        parser, options := newTestParser(t)
+        e := parser.ParseArgs(c.args, false)
+        if e != nil {
+            t.Errorf("ParseArgs %s error %s", c.args, e)
+            continue
+        }
+        if options.Timeout != c.timeout || options.Debug != c.debug || options.Region != c.region {
+            t.Errorf("ParseArgs %s = %#v", c.args, options)
+        }
+    }
+}
+
+func TestParseArgsAttachedValueError(t *testing.T) {
+    cases := [][]string{
+        {"--timeout=abc"},
+        {"--region=north"},
+        {"--debug=maybe"},
+    }
+    for _, c := range cases {
+        parser, _ := newTestParser(t)
+        if e := parser.ParseArgs(c, false); e == nil {
+            t.Errorf("ParseArgs %s should fail", c)
+        }
+    }
+}
+
+func TestParseArgsShortCluster(t *testing.T) {
+    cases := []struct {
+        args []string
+        help bool
+        debug bool
+        timeout int
+    } {
+        {[]string{"-hd"}, true, true, 600},
+        {[]string{"-dh"}, true, true, 600},
+        {[]string{"-hdt30"}, true, true, 30},
+        {[]string{"-dt", "30"}, false, true, 30},
+        {[]string{"-dt=30"}, false, true, 30},
+        {[]string{"-hd=false"}, true, false, 600},
+    }
+    for _, c := range cases {
+        parser, options := newTestParser(t)
+        e := parser.ParseArgs(c.args, false)
+        if e != nil {
+            t.Errorf("ParseArgs %s error %s", c.args, e)
+            continue
+        }
+        if options.Help != c.help || options.Debug != c.debug || options.Timeout != c.timeout {
+            t.Errorf("ParseArgs %s = %#v", c.args, options)
+        }
+    }
+}
+
+func TestParseArgsShortClusterError(t *testing.T) {
+    cases := [][]string{
+        {"-hx"},
+        {"-thd"},
+        {"-ht"},
+        {"-debug"},
+    }
+    for _, c := range cases {
+        parser, _ := newTestParser(t)
+        if e := parser.ParseArgs(c, false); e == nil {
+            t.Errorf("ParseArgs %s should fail", c)
+        }
+    }
+}
+
+type positionalOptions struct {
+    Debug bool      `help:"Show debug information" short-token:"d"`
+    OFFSET float64  `help:"Offset"`
+    NAME string     `help:"Name" optional:"true"`
+}
+
+func TestParseArgsPositionalDash(t *testing.T) {
+    cases := []struct {
+        args []string
+        debug bool
+        offset float64
+        name string
+    } {
+        {[]string{"-5"}, false, -5, ""},
+        {[]string{"-d", "-3.14", "x"}, true, -3.14, "x"},
+        {[]string{"1", "--", "-d"}, false, 1, "-d"},
+        {[]string{"--", "-2", "--"}, false, -2, "--"},
+        {[]string{"2", "-"}, false, 2, "-"},
+    }
+    for _, c := range cases {
+        options := &positionalOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        e = parser.ParseArgs(c.args, false)
+        if e != nil {
+            t.Errorf("ParseArgs %s error %s", c.args, e)
+            continue
+        }
+        if options.Debug != c.debug || options.OFFSET != c.offset || options.NAME != c.name {
+            t.Errorf("ParseArgs %s = %#v", c.args, options)
+        }
+    }
+}
+
+func TestParseArgsNegativeNumberNotPositional(t *testing.T) {
+    parser, _ := newTestParser(t)
+    if e := parser.ParseArgs([]string{"-5"}, false); e == nil {
+        t.Errorf("ParseArgs -5 should fail without a numeric positional argument")
+    }
+}
+
+type abbrevOptions struct {
+    Debug bool      `help:"Show debug information"`
+    DebugLevel int  `help:"Debug level"`
+    Verbose bool    `help:"Verbose output" short-token:"V"`
+}
+
+func TestFindOptionalArgument(t *testing.T) {
+    cases := []struct {
+        mode AbbrevMode
+        args []string
+        debug bool
+        level int
+        verbose bool
+        fail bool
+    } {
+        {ABBREV_UNIQUE, []string{"--debug"}, true, 0, false, false},
+        {ABBREV_UNIQUE, []string{"--debug-l", "3"}, false, 3, false, false},
+        {ABBREV_UNIQUE, []string{"--verb"}, false, 0, true, false},
+        {ABBREV_UNIQUE, []string{"--V"}, false, 0, true, false},
+        {ABBREV_UNIQUE, []string{"--deb"}, false, 0, false, true},
+        {ABBREV_WARN, []string{"--verb"}, false, 0, true, false},
+        {ABBREV_OFF, []string{"--debug"}, true, 0, false, false},
+        {ABBREV_OFF, []string{"--verb"}, false, 0, false, true},
+    }
+    for _, c := range cases {
+        options := &abbrevOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        parser.SetAbbrevMode(c.mode)
+        e = parser.ParseArgs(c.args, false)
+        if c.fail {
+            if e == nil {
+                t.Errorf("ParseArgs %s with mode %d should fail", c.args, c.mode)
+            }
+            continue
+        }
+        if e != nil {
+            t.Errorf("ParseArgs %s error %s", c.args, e)
+            continue
+        }
+        if options.Debug != c.debug || options.DebugLevel != c.level || options.Verbose != c.verbose {
+            t.Errorf("ParseArgs %s = %#v", c.args, options)
+        }
+    }
+}
+
+func TestFindOptionalArgumentAmbiguous(t *testing.T) {
+    parser, e := NewArgumentParser(&abbrevOptions{}, "test", "test prog", "")
+    if e != nil {
+        t.Fatalf("NewArgumentParser error %s", e)
+    }
+    e = parser.ParseArgs([]string{"--de"}, false)
+    if e == nil || e.Error() != "Ambiguous option --de could match --debug, --debug-level" {
+        t.Errorf("ParseArgs --de error %v", e)
+    }
+}
+
+type subcommandOptions struct {
+    Debug bool          `help:"Show debug information" short-token:"d"`
+    SUBCOMMAND string   `help:"Subcommand" subcommand:"true"`
+}
+
+type subcommandTestOptions struct {
+    NAME string     `help:"Test name"`
+    Arg1 string     `help:"Argument1"`
+}
+
+func newSubcommandParser(t *testing.T) (*ArgumentParser, *subcommandOptions, *subcommandTestOptions) {
+    options := &subcommandOptions{}
+    parser, e := NewArgumentParser(options, "test", "test prog", "")
+    if e != nil {
+        t.Fatalf("NewArgumentParser error %s", e)
+    }
+    suboptions := &subcommandTestOptions{}
+    _, e = parser.GetSubcommand().AddSubParser(suboptions, "test", "Run a test", func(opts *subcommandTestOptions) error {
+        return nil
+    })
+    if e != nil {
+        t.Fatalf("AddSubParser error %s", e)
+    }
+    return parser, options, suboptions
+}
+
+func TestEditDistance(t *testing.T) {
+    cases := []struct {
+        a string
+        b string
+        dist int
+    } {
+        {"test", "test", 0},
+        {"tset", "test", 1},
+        {"tiemout", "timeout", 1},
+        {"", "abc", 3},
+        {"kitten", "sitting", 3},
+    }
+    for _, c := range cases {
+        if editDistance(c.a, c.b) != c.dist {
+            t.Errorf("editDistance %s %s = %d, not %d", c.a, c.b, editDistance(c.a, c.b), c.dist)
+        }
+    }
+}
+
+func TestSuggestions(t *testing.T) {
+    cases := []struct {
+        args []string
+        err string
+    } {
+        {[]string{"--tiemout", "3"}, "Unknown optional argument --tiemout, did you mean --timeout?"},
+        {[]string{"--region", "eats"}, "Unknown argument \"eats\" for --region, choose from {east,west}, did you mean \"east\"?"},
+        {[]string{"--region", "north"}, "Unknown argument \"north\" for --region, choose from {east,west}"},
+        {[]string{"-z"}, "Unknown optional argument -z"},
+        {[]string{"-5"}, "Unknown optional argument -5"},
+        {[]string{"--ab"}, "Unknown optional argument --ab"},
+    }
+    for _, c := range cases {
+        parser, _ := newTestParser(t)
+        e := parser.ParseArgs(c.args, false)
+        if e == nil || e.Error() != c.err {
+            t.Errorf("ParseArgs %s error %v, not %s", c.args, e, c.err)
+        }
+    }
+    parser, _, _ := newSubcommandParser(t)
+    e := parser.ParseArgs([]string{"tset", "name"}, false)
+    if e == nil || e.Error() != "Unknown subcommand \"tset\", did you mean \"test\"?" {
+        t.Errorf("ParseArgs tset error %v", e)
+    }
+}
+
+func TestParseKnownArgsWithLeftovers(t *testing.T) {
+    cases := []struct {
+        args []string
+        leftovers []string
+        name string
+        arg1 string
+    } {
+        {[]string{"-d", "test", "a", "--arg1", "x"}, []string{}, "a", "x"},
+        {[]string{"test", "--foo", "1", "a"}, []string{"--foo", "a"}, "1", ""},
+        {[]string{"test", "a", "--foo", "1", "--bar", "2"}, []string{"--foo", "1", "--bar", "2"}, "a", ""},
+        {[]string{"test", "--bar=2", "a", "--baz", "b", "c"}, []string{"--bar=2", "--baz", "b", "c"}, "a", ""},
+        {[]string{"test", "a", "-x", "--", "-y", "z"}, []string{"-x", "--", "-y", "z"}, "a", ""},
+    }
+    for _, c := range cases {
+        parser, _, suboptions := newSubcommandParser(t)
+        leftovers, e := parser.ParseKnownArgsWithLeftovers(c.args)
+        if e != nil {
+            t.Errorf("ParseKnownArgsWithLeftovers %s error %s", c.args, e)
+            continue
+        }
+        if !reflect.DeepEqual(leftovers, c.leftovers) {
+            t.Errorf("ParseKnownArgsWithLeftovers %s = %s, not %s", c.args, leftovers, c.leftovers)
+        }
+        if suboptions.NAME != c.name || suboptions.Arg1 != c.arg1 {
+            t.Errorf("ParseKnownArgsWithLeftovers %s = %#v", c.args, suboptions)
+        }
+    }
+}
+
+type DBOptions struct {
+    Host string     `help:"Database host" short-token:"H"`
+    Port int        `help:"Database port" default:"3306"`
+}
+
+type LogOptions struct {
+    LogLevel string `help:"Log level" default:"info"`
+}
+
+type nestedOptions struct {
+    LogOptions
+    Main DBOptions      `prefix:"main-"`
+    Replica *DBOptions  `prefix:"replica-"`
+    Debug bool          `help:"Show debug information"`
+    internal DBOptions
+}
+
+func TestNestedStruct(t *testing.T) {
+    options := &nestedOptions{}
+    parser, e := NewArgumentParser(options, "test", "test prog", "")
+    if e != nil {
+        t.Fatalf("NewArgumentParser error %s", e)
+    }
+    args := []string{"--log-level", "debug", "--main-host", "a", "--replica-host", "b", "--replica-port", "3307", "--debug"}
+    e = parser.ParseArgs(args, false)
+    if e != nil {
+        t.Fatalf("ParseArgs %s error %s", args, e)
+    }
+    if options.LogLevel != "debug" || options.Main.Host != "a" || options.Main.Port != 3306 ||
+            options.Replica == nil || options.Replica.Host != "b" || options.Replica.Port != 3307 || ! options.Debug {
+        t.Errorf("ParseArgs %s = %#v", args, options)
+    }
+    if options.internal.Port != 0 {
+        t.Errorf("unexported field should be ignored")
+    }
+}
+
+func TestNestedStructDuplicateToken(t *testing.T) {
+    options := &struct {
+        Main DBOptions
+        Replica DBOptions
+    }{}
+    _, e := NewArgumentParser(options, "test", "test prog", "")
+    if e == nil {
+        t.Errorf("NewArgumentParser should fail with duplicate tokens")
+    }
+}
+
+type cyclicNode struct {
+    Name string
+    Next *cyclicNode `prefix:"next-"`
+}
+
+func TestNestedStructCycle(t *testing.T) {
+    cases := []interface{}{
+        &cyclicNode{},
+        &struct {
+            Head cyclicNode `prefix:"head-"`
+        }{},
+    }
+    for _, options := range cases {
+        _, e := NewArgumentParser(options, "test", "test prog", "")
+        if e == nil || ! strings.HasPrefix(e.Error(), "Cyclic struct pointer Next") {
+            t.Errorf("NewArgumentParser %T error %v", options, e)
+        }
+    }
+}
+
+type multiOptions struct {
+    Hosts []string  `help:"Hosts"`
+    Pair []int      `help:"A pair of numbers" nargs:"2"`
+    Color [3]uint8  `help:"RGB color"`
+    Ports []int     `help:"Ports" default:"80"`
+    FILES []string  `help:"Files"`
+}
+
+func TestMultiArgument(t *testing.T) {
+    cases := []struct {
+        args []string
+        hosts []string
+        pair []int
+        color [3]uint8
+        ports []int
+        files []string
+    } {
+        {[]string{"--hosts", "a", "b", "--", "f"}, []string{"a", "b"}, nil, [3]uint8{}, []int{80}, []string{"f"}},
+        {[]string{"f", "--hosts", "a", "--hosts=b", "g"}, []string{"a", "b"}, nil, [3]uint8{}, []int{80}, []string{"f", "g"}},
+        {[]string{"--pair", "-1", "2", "f"}, nil, []int{-1, 2}, [3]uint8{}, []int{80}, []string{"f"}},
+        {[]string{"--color", "1", "2", "3", "f", "g"}, nil, nil, [3]uint8{1, 2, 3}, []int{80}, []string{"f", "g"}},
+        {[]string{"--ports", "443", "8443", "--", "f"}, nil, nil, [3]uint8{}, []int{443, 8443}, []string{"f"}},
+    }
+    for _, c := range cases {
+        options := &multiOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        e = parser.ParseArgs(c.args, false)
+        if e != nil {
+            t.Errorf("ParseArgs %s error %s", c.args, e)
+            continue
+        }
+        if !reflect.DeepEqual(options.Hosts, c.hosts) || !reflect.DeepEqual(options.Pair, c.pair) ||
+                options.Color != c.color || !reflect.DeepEqual(options.Ports, c.ports) ||
+                !reflect.DeepEqual(options.FILES, c.files) {
+            t.Errorf("ParseArgs %s = %#v", c.args, options)
+        }
+    }
+}
+
+func TestMultiArgumentError(t *testing.T) {
+    cases := [][]string{
+        {"--pair", "1", "f"},
+        {"--pair", "1", "--hosts", "a", "f"},
+        {"--color", "1", "2", "f"},
+        {"--hosts", "a"},
+    }
+    for _, c := range cases {
+        parser, e := NewArgumentParser(&multiOptions{}, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        if e = parser.ParseArgs(c, false); e == nil {
+            t.Errorf("ParseArgs %s should fail", c)
+        }
+    }
+}
+
+type sepOptions struct {
+    Zones []string  `help:"Zones" sep:"," default:"a,b"`
+    Ports []int     `help:"Ports" sep:":"`
+    Sizes [3]int    `help:"Sizes" sep:"x"`
+    Tags []string   `help:"Tags" sep:"," choices:"x|y|z"`
+}
+
+func TestSepArgument(t *testing.T) {
+    cases := []struct {
+        args []string
+        zones []string
+        ports []int
+        sizes [3]int
+        tags []string
+    } {
+        {[]string{}, []string{"a", "b"}, nil, [3]int{}, nil},
+        {[]string{"--zones", "c, d,"}, []string{"c", "d"}, nil, [3]int{}, nil},
+        {[]string{"--zones=c", "--zones", "d,e"}, []string{"c", "d", "e"}, nil, [3]int{}, nil},
+        {[]string{"--ports", "80:443", "--ports", "8080"}, []string{"a", "b"}, []int{80, 443, 8080}, [3]int{}, nil},
+        {[]string{"--sizes", "1x2x3"}, []string{"a", "b"}, nil, [3]int{1, 2, 3}, nil},
+        {[]string{"--tags", "x,z"}, []string{"a", "b"}, nil, [3]int{}, []string{"x", "z"}},
+    }
+    for _, c := range cases {
+        options := &sepOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        e = parser.ParseArgs(c.args, false)
+        if e != nil {
+            t.Errorf("ParseArgs %s error %s", c.args, e)
+            continue
+        }
+        if !reflect.DeepEqual(options.Zones, c.zones) || !reflect.DeepEqual(options.Ports, c.ports) ||
+                options.Sizes != c.sizes || !reflect.DeepEqual(options.Tags, c.tags) {
+            t.Errorf("ParseArgs %s = %#v", c.args, options)
+        }
+    }
+    parser, _ := NewArgumentParser(&sepOptions{}, "test", "test prog", "")
+    if e := parser.ParseArgs([]string{"--tags", "x,w"}, false); e == nil {
+        t.Errorf("ParseArgs --tags x,w should fail")
+    }
+    _, e := NewArgumentParser(&struct {
+        Zone string `sep:","`
+    }{}, "test", "test prog", "")
+    if e == nil {
+        t.Errorf("sep on a string field should fail")
+    }
+}
+
+type mapOptions struct {
+    Label map[string]string     `help:"Labels" default:"env=dev"`
+    Quota map[string]int        `help:"Quotas" sep:"," duplicate:"error"`
+}
+
+func TestMapArgument(t *testing.T) {
+    cases := []struct {
+        args []string
+        label map[string]string
+        quota map[string]int
+    } {
+        {[]string{}, map[string]string{"env": "dev"}, nil},
+        {[]string{"--label", "env=prod", "--label=tier=db"}, map[string]string{"env": "prod", "tier": "db"}, nil},
+        {[]string{"--label", "a=1", "--label", "a=2"}, map[string]string{"a": "2"}, nil},
+        {[]string{"--quota", "cpu=2, mem=4", "--quota", "disk=10"}, map[string]string{"env": "dev"}, map[string]int{"cpu": 2, "mem": 4, "disk": 10}},
+    }
+    for _, c := range cases {
+        options := &mapOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        e = parser.ParseArgs(c.args, false)
+        if e != nil {
+            t.Errorf("ParseArgs %s error %s", c.args, e)
+            continue
+        }
+        if !reflect.DeepEqual(options.Label, c.label) || !reflect.DeepEqual(options.Quota, c.quota) {
+            t.Errorf("ParseArgs %s = %#v", c.args, options)
+        }
+    }
+    errors := [][]string{
+        {"--quota", "cpu=2,cpu=3"},
+        {"--quota", "cpu=x"},
+        {"--label", "env"},
+    }
+    for _, c := range errors {
+        parser, _ := NewArgumentParser(&mapOptions{}, "test", "test prog", "")
+        if e := parser.ParseArgs(c, false); e == nil {
+            t.Errorf("ParseArgs %s should fail", c)
+        }
+    }
+    parser, _ := NewArgumentParser(&struct {
+        Label map[string]string `help:"Labels"`
+        Env map[string]string   `help:"Environment" metavar:"NAME=VALUE"`
+    }{}, "test", "test prog", "")
+    help := parser.HelpString()
+    for _, usage := range []string{"[--label KEY=VALUE]", "[--env NAME=VALUE]"} {
+        if ! strings.Contains(help, usage) {
+            t.Errorf("HelpString should show %s: %s", usage, help)
+        }
+    }
+}
+
+func writeTestFile(t *testing.T, name string, content string) string {
+    path := filepath.Join(t.TempDir(), name)
+    e := os.WriteFile(path, []byte(content), 0644)
+    if e != nil {
+        t.Fatalf("WriteFile error %s", e)
+    }
+    return path
+}
+
+func TestMapArgumentParseFile(t *testing.T) {
+    options := &mapOptions{}
+    parser, e := NewArgumentParser(options, "test", "test prog", "")
+    if e != nil {
+        t.Fatalf("NewArgumentParser error %s", e)
+    }
+    path := writeTestFile(t, "test.conf", "label = env=prod\nlabel = tier=db\nquota = cpu=2,mem=4\n")
+    e = parser.ParseFile(path)
+    if e != nil {
+        t.Fatalf("ParseFile error %s", e)
+    }
+    if !reflect.DeepEqual(options.Label, map[string]string{"env": "prod", "tier": "db"}) ||
+            !reflect.DeepEqual(options.Quota, map[string]int{"cpu": 2, "mem": 4}) {
+        t.Errorf("ParseFile = %#v", options)
+    }
+}
+
+type actionOptions struct {
+    Verbose int         `help:"Verbosity" short-token:"v" action:"count"`
+    Quiet uint          `help:"Quietness" short-token:"q" action:"count" default:"1"`
+    Fast bool           `help:"Fast preset" action:"store_const" const:"true"`
+    Level string        `help:"Level preset" action:"store_const" const:"high"`
+    Preset []string     `help:"Add preset" token:"add-a" action:"append_const" const:"a"`
+    PresetB []string    `help:"Add preset" token:"add-b" action:"append_const" const:"b"`
+    Flag []string       `help:"Flags" action:"append"`
+    FILES []string      `help:"Files" optional:"true"`
+}
+
+func TestActionArgument(t *testing.T) {
+    cases := []struct {
+        args []string
+        verbose int
+        quiet uint
+        level string
+        preset []string
+        flag []string
+        files []string
+    } {
+        {[]string{}, 0, 1, "", nil, nil, nil},
+        {[]string{"-vvv", "-v", "-qq"}, 4, 3, "", nil, nil, nil},
+        {[]string{"--fast", "--level", "--add-a", "--add-a"}, 0, 1, "high", []string{"a", "a"}, nil, nil},
+        {[]string{"--flag", "x", "f", "--flag", "y", "g"}, 0, 1, "", nil, []string{"x", "y"}, []string{"f", "g"}},
+    }
+    for _, c := range cases {
+        options := &actionOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        e = parser.ParseArgs(c.args, false)
+        if e != nil {
+            t.Errorf("ParseArgs %s error %s", c.args, e)
+            continue
+        }
+        if options.Verbose != c.verbose || options.Quiet != c.quiet || options.Level != c.level ||
+                !reflect.DeepEqual(options.Preset, c.preset) || !reflect.DeepEqual(options.Flag, c.flag) ||
+                !reflect.DeepEqual(options.FILES, c.files) {
+            t.Errorf("ParseArgs %s = %#v", c.args, options)
+        }
+    }
+}
+
+func TestActionArgumentError(t *testing.T) {
+    cases := []interface{}{
+        &struct {
+            Verbose string `action:"count"`
+        }{},
+        &struct {
+            Level string `action:"store_const"`
+        }{},
+        &struct {
+            Level string `const:"a"`
+        }{},
+        &struct {
+            Flag string `action:"append"`
+        }{},
+        &struct {
+            Flag string `action:"unknown"`
+        }{},
+    }
+    for _, c := range cases {
+        if _, e := NewArgumentParser(c, "test", "test prog", ""); e == nil {
+            t.Errorf("NewArgumentParser %#v should fail", c)
+        }
+    }
+}
+
+type negatableOptions struct {
+    Cache bool      `help:"Use cache" default:"true" short-token:"c"`
+    Color *bool     `help:"Colored output"`
+    NoWait bool     `help:"Do not wait"`
+    Wait int        `help:"Seconds to wait"`
+}
+
+func TestNegatableArgument(t *testing.T) {
+    boolPtr := func(b bool) *bool {
+        return &b
+    }
+    cases := []struct {
+        args []string
+        cache bool
+        color *bool
+        nowait bool
+    } {
+        {[]string{}, true, nil, false},
+        {[]string{"--cache"}, true, nil, false},
+        {[]string{"-c"}, true, nil, false},
+        {[]string{"--no-cache"}, false, nil, false},
+        {[]string{"--no-cache", "--cache"}, true, nil, false},
+        {[]string{"--cache=false"}, false, nil, false},
+        {[]string{"--color"}, true, boolPtr(true), false},
+        {[]string{"--no-color"}, true, boolPtr(false), false},
+        {[]string{"--no-wait"}, true, nil, true},
+        {[]string{"--no-ca"}, false, nil, false},
+    }
+    for _, c := range cases {
+        options := &negatableOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        e = parser.ParseArgs(c.args, false)
+        if e != nil {
+            t.Errorf("ParseArgs %s error %s", c.args, e)
+            continue
+        }
+        if options.Cache != c.cache || !reflect.DeepEqual(options.Color, c.color) || options.NoWait != c.nowait {
+            t.Errorf("ParseArgs %s = %#v", c.args, options)
+        }
+    }
+    parser, _ := NewArgumentParser(&negatableOptions{}, "test", "test prog", "")
+    if e := parser.ParseArgs([]string{"--no-cache=true"}, false); e == nil {
+        t.Errorf("ParseArgs --no-cache=true should fail")
+    }
+    usage := parser.Usage()
+    if !strings.Contains(usage, "[--[no-]cache]") || !strings.Contains(usage, "[--[no-]color]") {
+        t.Errorf("Usage %s", usage)
+    }
+    conflicts := []struct {
+        options interface{}
+        err string
+    } {
+        {&struct {
+            Cache bool
+            NoCache bool
+        }{}, "Argument token --no-cache conflicts with the negation of --cache"},
+        {&struct {
+            NoCache string
+            Cache *bool
+        }{}, "Negation of argument token --cache conflicts with --no-cache"},
+    }
+    for _, c := range conflicts {
+        _, e := NewArgumentParser(c.options, "test", "test prog", "")
+        if e == nil || e.Error() != c.err {
+            t.Errorf("NewArgumentParser %#v error %v, expect %s", c.options, e, c.err)
+        }
+    }
+}
+
+type pointerOptions struct {
+    Timeout *int                `help:"Timeout"`
+    Name *string                `help:"Name" choices:"a|b"`
+    Interval *time.Duration     `help:"Interval" default:"1m"`
+    Retry *uint                 `help:"Retry"`
+}
+
+func TestPointerArgument(t *testing.T) {
+    cases := []struct {
+        args []string
+        timeout interface{}
+        name interface{}
+        interval time.Duration
+    } {
+        {[]string{}, nil, nil, time.Minute},
+        {[]string{"--timeout", "0"}, 0, nil, time.Minute},
+        {[]string{"--name", "a", "--interval", "5s"}, nil, "a", 5 * time.Second},
+    }
+    for _, c := range cases {
+        options := &pointerOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        e = parser.ParseArgs(c.args, false)
+        if e != nil {
+            t.Errorf("ParseArgs %s error %s", c.args, e)
+            continue
+        }
+        if (c.timeout == nil) != (options.Timeout == nil) || (c.timeout != nil && *options.Timeout != c.timeout) ||
+                (c.name == nil) != (options.Name == nil) || (c.name != nil && *options.Name != c.name) ||
+                options.Interval == nil || *options.Interval != c.interval || options.Retry != nil {
+            t.Errorf("ParseArgs %s = %#v", c.args, options)
+        }
+    }
+    options := &pointerOptions{}
+    parser, _ := NewArgumentParser(options, "test", "test prog", "")
+    path := writeTestFile(t, "test.conf", "retry = 3\n")
+    if e := parser.ParseFile(path); e != nil || options.Retry == nil || *options.Retry != 3 {
+        t.Errorf("ParseFile = %#v, %v", options, e)
+    }
+    if e := parser.ParseArgs([]string{"--timeout", "x"}, false); e == nil || options.Timeout != nil {
+        t.Errorf("ParseArgs --timeout x should fail and leave the pointer nil")
+    }
+}
+
+type sourceOptions struct {
+    Timeout int         `help:"Timeout" default:"600"`
+    AuthURL string      `help:"Auth URL" default:"$STRUCTARG_TEST_AUTH_URL|http://localhost"`
+    Region string       `help:"Region"`
+    Debug bool          `help:"Debug"`
+    Secret *string      `help:"Secret"`
+}
+
+func TestArgumentSource(t *testing.T) {
+    os.Setenv("STRUCTARG_TEST_AUTH_URL", "http://auth")
+    defer os.Unsetenv("STRUCTARG_TEST_AUTH_URL")
+    options := &sourceOptions{}
+    parser, e := NewArgumentParser(options, "test", "test prog", "")
+    if e != nil {
+        t.Fatalf("NewArgumentParser error %s", e)
+    }
+    path := writeTestFile(t, "test.conf", "region = west\n")
+    e = parser.ParseArgs([]string{"--debug"}, false)
+    if e != nil {
+        t.Fatalf("ParseArgs error %s", e)
+    }
+    parser.ParseFile(path)
+    cases := []struct {
+        token string
+        set bool
+        source ArgumentSource
+    } {
+        {"timeout", false, ArgumentSource{Kind: SOURCE_DEFAULT}},
+        {"auth-url", true, ArgumentSource{Kind: SOURCE_ENV, EnvVar: "STRUCTARG_TEST_AUTH_URL"}},
+        {"region", true, ArgumentSource{Kind: SOURCE_FILE, File: path, Line: 1}},
+        {"debug", true, ArgumentSource{Kind: SOURCE_CLI}},
+        {"secret", false, ArgumentSource{Kind: SOURCE_NONE}},
+    }
+    for _, c := range cases {
+        src, ok := parser.Source(c.token)
+        if ! ok || src != c.source || parser.IsSet(c.token) != c.set {
+            t.Errorf("Source %s = %s, %v", c.token, src, parser.IsSet(c.token))
+        }
+    }
+    if _, ok := parser.Source("unknown"); ok {
+        t.Errorf("Source unknown should not be found")
+    }
+    config := parser.ConfigString()
+    expect := "timeout = 600 (default)\nauth-url = http://auth (env STRUCTARG_TEST_AUTH_URL)\n" +
+            "region = west (file " + path + ":1)\ndebug = true (command line)\nsecret =  (unset)\n"
+    if config != expect {
+        t.Errorf("ConfigString = %q", config)
+    }
+}
+
+type configOptions struct {
+    Config string `help:"Configuration file" config:"true"`
+    Timeout int `default:"600" help:"Timeout"`
+    Region string `help:"Region"`
+    Tags []string `help:"Tags"`
+}
+
+func TestConfigArgument(t *testing.T) {
+    path := writeTestFile(t, "test.conf", "timeout = 30\nregion = west\ntags = a\n")
+    cases := []struct {
+        args []string
+        timeout int
+        region string
+        tags []string
+        source SourceKind
+    } {
+        {[]string{}, 600, "", nil, SOURCE_DEFAULT},
+        {[]string{"--config", path}, 30, "west", []string{"a"}, SOURCE_FILE},
+        {[]string{"--timeout", "10", "--config", path}, 10, "west", []string{"a"}, SOURCE_CLI},
+        {[]string{"--config=" + path, "--timeout=10", "--region", "east"}, 10, "east", []string{"a"}, SOURCE_CLI},
+        {[]string{"--config", path, "--tags", "b", "c"}, 30, "west", []string{"b", "c"}, SOURCE_FILE},
+    }
+    for _, c := range cases {
+        options := &configOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        e = parser.ParseArgs(c.args, false)
+        if e != nil {
+            t.Errorf("ParseArgs %v error %s", c.args, e)
+            continue
+        }
+        src, _ := parser.Source("timeout")
+        if options.Timeout != c.timeout || options.Region != c.region || ! reflect.DeepEqual(options.Tags, c.tags) || src.Kind != c.source {
+            t.Errorf("ParseArgs %v = %d %q %v %s", c.args, options.Timeout, options.Region, options.Tags, src)
+        }
+    }
+}
+
+type defaultConfigOptions struct {
+    Config string `help:"Configuration file" config:"true" default:"/nonexistent/structarg.conf"`
+    Timeout int `default:"600" help:"Timeout"`
+}
+
+func TestConfigArgumentDefault(t *testing.T) {
+    options := &defaultConfigOptions{}
+    parser, e := NewArgumentParser(options, "test", "test prog", "")
+    if e != nil {
+        t.Fatalf("NewArgumentParser error %s", e)
+    }
+    e = parser.ParseArgs([]string{}, false)
+    if e != nil || options.Timeout != 600 {
+        t.Errorf("Missing default config file should be ignored: %s %d", e, options.Timeout)
+    }
+    e = parser.ParseArgs([]string{"--config", "/nonexistent/structarg.conf"}, false)
+    if e == nil {
+        t.Errorf("Missing explicit config file should be an error")
+    }
+}
+
+type duplicateConfigOptions struct {
+    Config string `config:"true"`
+    Config2 string `config:"true"`
+}
+
+type intConfigOptions struct {
+    Config int `config:"true"`
+}
+
+func TestConfigArgumentError(t *testing.T) {
+    _, e := NewArgumentParser(&duplicateConfigOptions{}, "test", "test prog", "")
+    if e == nil {
+        t.Errorf("Duplicate config argument should be an error")
+    }
+    _, e = NewArgumentParser(&intConfigOptions{}, "test", "test prog", "")
+    if e == nil {
+        t.Errorf("Non-string config argument should be an error")
+    }
+}
+
+type serverOptions struct {
+    SUBCOMMAND string `help:"Server subcommand" subcommand:"true"`
+}
+
+type serverCreateOptions struct {
+    Flavor string `help:"Flavor"`
+}
+
+func TestParseFileSections(t *testing.T) {
+    parser, options, suboptions := newSubcommandParser(t)
+    server, e := parser.GetSubcommand().AddSubParser(&serverOptions{}, "server", "Server commands", func(opts *serverOptions) error {
+        return nil
+    })
+    if e != nil {
+        t.Fatalf("AddSubParser error %s", e)
+    }
+    createoptions := &serverCreateOptions{}
+    _, e = server.GetSubcommand().AddSubParser(createoptions, "create", "Create a server", func(opts *serverCreateOptions) error {
+        return nil
+    })
+    if e != nil {
+        t.Fatalf("AddSubParser error %s", e)
+    }
+    path := writeTestFile(t, "test.conf", "debug = true\n[test]\narg1 = file\n[server.create]\nflavor = small\n")
+    e = parser.ParseFile(path)
+    if e != nil {
+        t.Fatalf("ParseFile error %s", e)
+    }
+    if ! options.Debug || suboptions.Arg1 != "file" || createoptions.Flavor != "small" {
+        t.Errorf("ParseFile = %v %q %q", options.Debug, suboptions.Arg1, createoptions.Flavor)
+    }
+    e = parser.ParseArgs([]string{"test", "--arg1", "cli", "name"}, false)
+    if e != nil {
+        t.Fatalf("ParseArgs error %s", e)
+    }
+    if suboptions.Arg1 != "cli" {
+        t.Errorf("command line should override the config file, got %q", suboptions.Arg1)
+    }
+    parser.SetUnknownKeyMode(UNKNOWN_KEY_STRICT)
+    for _, content := range []string{"[unknown]\na = 1\n", "[test.create]\na = 1\n", "[server.delete]\na = 1\n"} {
+        path = writeTestFile(t, "test.conf", content)
+        e = parser.ParseFile(path)
+        if e == nil || ! strings.Contains(e.Error(), "test.conf:2: Unknown section") {
+            t.Errorf("ParseFile %q error %v", content, e)
+        }
+    }
+}
+
+type profileOptions struct {
+    Config string `help:"Configuration file" config:"true"`
+    Profile string `help:"Configuration profile" profile:"true" default:"$STRUCTARG_TEST_PROFILE"`
+    Timeout int `default:"600" help:"Timeout"`
+    Region string `help:"Region"`
+    Tags []string `help:"Tags"`
+}
+
+func TestConfigProfile(t *testing.T) {
+    path := writeTestFile(t, "test.conf", "timeout = 30\ntags = a\ntags = b\n" +
+            "[profile staging]\nregion = east\n" +
+            "[profile prod]\ninherits = staging\ntags = c\n")
+    cases := []struct {
+        env string
+        args []string
+        timeout int
+        region string
+        tags []string
+    } {
+        {"", []string{"--config", path}, 30, "", []string{"a", "b"}},
+        {"", []string{"--config", path, "--profile", "staging"}, 30, "east", []string{"a", "b"}},
+        {"", []string{"--profile=prod", "--config", path}, 30, "east", []string{"c"}},
+        {"prod", []string{"--config", path}, 30, "east", []string{"c"}},
+        {"prod", []string{"--config", path, "--profile", "staging", "--tags", "d"}, 30, "east", []string{"d"}},
+    }
+    for _, c := range cases {
+        os.Setenv("STRUCTARG_TEST_PROFILE", c.env)
+        options := &profileOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        e = parser.ParseArgs(c.args, false)
+        if e != nil {
+            t.Errorf("ParseArgs %v error %s", c.args, e)
+            continue
+        }
+        if options.Timeout != c.timeout || options.Region != c.region || ! reflect.DeepEqual(options.Tags, c.tags) {
+            t.Errorf("ParseArgs %v = %d %q %v", c.args, options.Timeout, options.Region, options.Tags)
+        }
+    }
+    os.Unsetenv("STRUCTARG_TEST_PROFILE")
+    options := &profileOptions{}
+    parser, _ := NewArgumentParser(options, "test", "test prog", "")
+    e := parser.ParseArgs([]string{"--config", path, "--profile", "dev"}, false)
+    if e == nil || ! strings.Contains(e.Error(), "Unknown profile dev") {
+        t.Errorf("Unknown profile error %v", e)
+    }
+}
+
+type decodeDBOptions struct {
+    Host string `help:"Database host"`
+    Port int `help:"Database port" default:"3306"`
+}
+
+type decodeOptions struct {
+    Timeout int `default:"600" help:"Timeout"`
+    Region string `help:"Region" choices:"east|west"`
+    Tags []string `help:"Tags"`
+    Label map[string]string `help:"Labels"`
+    DB decodeDBOptions `prefix:"db-"`
+    SUBCOMMAND string `help:"Subcommand" subcommand:"true"`
+}
+
+func TestParseFileDecoders(t *testing.T) {
+    cases := []struct {
+        name string
+        content string
+    } {
+        {"test.json", `{"timeout": 30, "region": "west", "tags": ["a", "b"], "label": {"env": "prod"},
+            "db": {"host": "db1", "port": 3307}, "test": {"arg1": "file"}}`},
+        {"test.yaml", "timeout: 30\nregion: west\ntags:\n  - a\n  - b\nlabel:\n  env: prod\n" +
+            "db:\n  host: db1\n  port: 3307\ntest:\n  arg1: file\n"},
+        {"test.toml", "timeout = 30\nregion = \"west\"\ntags = [\"a\", \"b\"]\nlabel.env = \"prod\"\n" +
+            "[db]\nhost = \"db1\"\nport = 3307\n[test]\narg1 = \"file\"\n"},
+        {"test.conf", "timeout = 30\nregion = west\ntags = a\ntags = b\n[label]\nenv = prod\n" +
+            "[db]\nhost = db1\nport = 3307\n[test]\narg1 = file\n"},
+    }
+    for _, c := range cases {
+        options := &decodeOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        suboptions := &subcommandTestOptions{}
+        parser.GetSubcommand().AddSubParser(suboptions, "test", "Run a test", func(opts *subcommandTestOptions) error {
+            return nil
+        })
+        e = parser.ParseFile(writeTestFile(t, c.name, c.content))
+        if e != nil {
+            t.Errorf("ParseFile %s error %s", c.name, e)
+            continue
+        }
+        if options.Timeout != 30 || options.Region != "west" || ! reflect.DeepEqual(options.Tags, []string{"a", "b"}) ||
+                ! reflect.DeepEqual(options.Label, map[string]string{"env": "prod"}) ||
+                options.DB.Host != "db1" || options.DB.Port != 3307 || suboptions.Arg1 != "file" {
+            t.Errorf("ParseFile %s = %v %v", c.name, options, suboptions)
+        }
+    }
+    options := &decodeOptions{}
+    parser, _ := NewArgumentParser(options, "test", "test prog", "")
+    e := parser.ParseFileFormat(writeTestFile(t, "test.conf", "{\"timeout\": 30,\n\"region\": \"north\"}"), "json")
+    if e == nil || ! strings.Contains(e.Error(), "test.conf:2: Unknown argument \"north\" for --region") || options.Region != "" {
+        t.Errorf("ParseFileFormat should validate choices: %v %q", e, options.Region)
+    }
+}
+
+type testLogger struct {
+    messages []string
+}
+
+func (this *testLogger) Printf(format string, v ...interface{}) {
+    this.messages = append(this.messages, fmt.Sprintf(format, v...))
+}
+
+func TestUnknownKeyMode(t *testing.T) {
+    path := writeTestFile(t, "test.conf", "timeout = 30\ntimeuot = 10\n[unknown]\na = 1\n")
+    cases := []struct {
+        mode UnknownKeyMode
+        err string
+        messages []string
+    } {
+        {UNKNOWN_KEY_WARN, "", []string{"Unknown config key timeuot, did you mean timeout?", "Unknown section [unknown]"}},
+        {UNKNOWN_KEY_IGNORE, "", nil},
+        {UNKNOWN_KEY_STRICT, "test.conf:2: Unknown config key timeuot, did you mean timeout?", nil},
+    }
+    for _, c := range cases {
+        parser, options := newTestParser(t)
+        logger := &testLogger{}
+        parser.SetLogger(logger)
+        parser.SetUnknownKeyMode(c.mode)
+        e := parser.ParseFile(path)
+        if len(c.err) > 0 {
+            if e == nil || ! strings.HasSuffix(e.Error(), c.err) {
+                t.Errorf("ParseFile mode %d error %v", c.mode, e)
+            }
+        }else if e != nil || options.Timeout != 30 {
+            t.Errorf("ParseFile mode %d error %v", c.mode, e)
+        }
+        if ! reflect.DeepEqual(logger.messages, c.messages) {
+            t.Errorf("ParseFile mode %d messages %v", c.mode, logger.messages)
+        }
+    }
+}
+
+func TestConfigKeyExact(t *testing.T) {
+    for _, key := range []string{"time", "reg", "t", "d"} {
+        parser, options := newTestParser(t)
+        logger := &testLogger{}
+        parser.SetLogger(logger)
+        parser.SetAbbrevMode(ABBREV_WARN)
+        parser.SetUnknownKeyMode(UNKNOWN_KEY_STRICT)
+        e := parser.ParseFile(writeTestFile(t, "test.conf", key + " = 5\n"))
+        if e == nil || ! strings.Contains(e.Error(), "test.conf:1: Unknown config key " + key) {
+            t.Errorf("ParseFile key %s error %v", key, e)
+        }
+        if options.Timeout == 5 || len(logger.messages) > 0 {
+            t.Errorf("ParseFile key %s = %d %v", key, options.Timeout, logger.messages)
+        }
+    }
+    parser, options := newTestParser(t)
+    e := parser.ParseFile(writeTestFile(t, "test.conf", "timeout = 5\nno-debug = false\n"))
+    if e != nil || options.Timeout != 5 || ! options.Debug {
+        t.Errorf("ParseFile = %d %v %v", options.Timeout, options.Debug, e)
+    }
+}
+
+func TestSetLogger(t *testing.T) {
+    parser, _, _ := newSubcommandParser(t)
+    logger := &testLogger{}
+    parser.SetLogger(logger)
+    parser.SetAbbrevMode(ABBREV_WARN)
+    e := parser.ParseArgs([]string{"test", "--arg", "x", "name"}, false)
+    if e != nil {
+        t.Fatalf("ParseArgs error %s", e)
+    }
+    if ! reflect.DeepEqual(logger.messages, []string{"Option --arg is an abbreviation of --arg1"}) {
+        t.Errorf("SetLogger messages %v", logger.messages)
+    }
+    parser.SetLogger(nil)
+    e = parser.ParseArgs([]string{"test", "--arg", "x", "name"}, false)
+    if e != nil || len(logger.messages) != 1 {
+        t.Errorf("A nil logger should disable warnings: %v %v", e, logger.messages)
+    }
+}
+
+type envOptions struct {
+    Config string `help:"Configuration file" config:"true"`
+    Timeout int `default:"600" help:"Timeout"`
+    AuthURL string `help:"Authentication URL" env:"STRUCTARG_TEST_OS_AUTH_URL"`
+    Region string `help:"Region" choices:"east|west"`
+    Debug bool `help:"Debug"`
+    Tags []string `help:"Tags" sep:","`
+    Secret string `help:"Secret" env:"-"`
+    SUBCOMMAND string `help:"Subcommand" subcommand:"true"`
+}
+
+func TestEnvPrefix(t *testing.T) {
+    path := writeTestFile(t, "test.conf", "timeout = 30\n[test]\narg1 = file\n")
+    env := map[string]string{
+        "STRUCTARG_TEST_TIMEOUT": "10",
+        "STRUCTARG_TEST_OS_AUTH_URL": "http://auth",
+        "STRUCTARG_TEST_AUTH_URL": "http://ignored",
+        "STRUCTARG_TEST_REGION": "west",
+        "STRUCTARG_TEST_DEBUG": "true",
+        "STRUCTARG_TEST_TAGS": "a,b",
+        "STRUCTARG_TEST_SECRET": "ignored",
+        "STRUCTARG_TEST_ARG1": "env",
+    }
+    for k, v := range env {
+        os.Setenv(k, v)
+        defer os.Unsetenv(k)
+    }
+    cases := []struct {
+        args []string
+        timeout int
+        tags []string
+        arg1 string
+        source SourceKind
+    } {
+        {[]string{"test", "name"}, 10, []string{"a", "b"}, "env", SOURCE_ENV},
+        {[]string{"--config", path, "test", "name"}, 30, []string{"a", "b"}, "file", SOURCE_FILE},
+        {[]string{"--config", path, "--timeout", "5", "--tags", "c", "test", "--arg1", "cli", "name"}, 5, []string{"c"}, "cli", SOURCE_CLI},
+    }
+    for _, c := range cases {
+        options := &envOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        suboptions := &subcommandTestOptions{}
+        parser.GetSubcommand().AddSubParser(suboptions, "test", "Run a test", func(opts *subcommandTestOptions) error {
+            return nil
+        })
+        parser.SetEnvPrefix("STRUCTARG_TEST_")
+        e = parser.ParseArgs(c.args, false)
+        if e != nil {
+            t.Errorf("ParseArgs %v error %s", c.args, e)
+            continue
+        }
+        src, _ := parser.Source("timeout")
+        if options.Timeout != c.timeout || ! reflect.DeepEqual(options.Tags, c.tags) || suboptions.Arg1 != c.arg1 || src.Kind != c.source {
+            t.Errorf("ParseArgs %v = %d %v %q %s", c.args, options.Timeout, options.Tags, suboptions.Arg1, src)
+        }
+        if options.AuthURL != "http://auth" || options.Region != "west" || ! options.Debug || options.Secret != "" {
+            t.Errorf("ParseArgs %v = %q %q %v %q", c.args, options.AuthURL, options.Region, options.Debug, options.Secret)
+        }
+    }
+    options := &envOptions{}
+    parser, _ := NewArgumentParser(options, "test", "test prog", "")
+    parser.SetEnvPrefix("STRUCTARG_TEST_")
+    help := parser.HelpString()
+    for _, env := range []string{"[env: STRUCTARG_TEST_TIMEOUT]", "[env: STRUCTARG_TEST_OS_AUTH_URL]", "[env: STRUCTARG_TEST_CONFIG]"} {
+        if ! strings.Contains(help, env) {
+            t.Errorf("HelpString should show %s", env)
+        }
+    }
+    if strings.Contains(help, "STRUCTARG_TEST_SECRET") || strings.Contains(help, "STRUCTARG_TEST_SUBCOMMAND") {
+        t.Errorf("HelpString should not show opted out variables")
+    }
+    os.Setenv("STRUCTARG_TEST_REGION", "north")
+    e := parser.ParseArgs([]string{}, false)
+    if e == nil || ! strings.HasPrefix(e.Error(), "Invalid value of env STRUCTARG_TEST_REGION: Unknown argument \"north\"") {
+        t.Errorf("Invalid env value error %v", e)
+    }
+}
+
+type expandOptions struct {
+    CacheDir string `help:"Cache directory" default:"${STRUCTARG_TEST_HOME:-/tmp}/.climc/cache"`
+    Token string `help:"Token" default:"${STRUCTARG_TEST_TOKEN:?set STRUCTARG_TEST_TOKEN}"`
+    Port int `help:"Port" default:"${STRUCTARG_TEST_PORT:-80}"`
+    Path string `help:"Path"`
+    Pattern string `help:"Pattern"`
+}
+
+func TestEnvPrefixPositional(t *testing.T) {
+    os.Setenv("STRUCTARG_TEST_NAME", "env")
+    os.Setenv("STRUCTARG_TEST_FILE", "file")
+    defer os.Unsetenv("STRUCTARG_TEST_NAME")
+    defer os.Unsetenv("STRUCTARG_TEST_FILE")
+    options := &struct {
+        NAME string `optional:"true"`
+        FILE string `optional:"true" env:"STRUCTARG_TEST_FILE"`
+    }{}
+    parser, e := NewArgumentParser(options, "test", "test prog", "")
+    if e != nil {
+        t.Fatalf("NewArgumentParser error %s", e)
+    }
+    parser.SetEnvPrefix("STRUCTARG_TEST_")
+    e = parser.ParseArgs([]string{}, false)
+    if e != nil || options.NAME != "" || options.FILE != "file" {
+        t.Errorf("ParseArgs = %q %q %v", options.NAME, options.FILE, e)
+    }
+    if strings.Contains(parser.HelpString(), "STRUCTARG_TEST_NAME") {
+        t.Errorf("HelpString should not bind a positional argument: %s", parser.HelpString())
+    }
+}
+
+func TestExpandDefault(t *testing.T) {
+    os.Setenv("STRUCTARG_TEST_TOKEN", "secret")
+    defer os.Unsetenv("STRUCTARG_TEST_TOKEN")
+    options := &expandOptions{}
+    parser, e := NewArgumentParser(options, "test", "test prog", "")
+    if e != nil {
+        t.Fatalf("NewArgumentParser error %s", e)
+    }
+    os.Setenv("STRUCTARG_TEST_HOME", "/home/test")
+    defer os.Unsetenv("STRUCTARG_TEST_HOME")
+    e = parser.ParseArgs([]string{}, false)
+    if e != nil {
+        t.Fatalf("ParseArgs error %s", e)
+    }
+    if options.CacheDir != "/home/test/.climc/cache" || options.Token != "secret" || options.Port != 80 {
+        t.Errorf("ParseArgs = %q %q %d", options.CacheDir, options.Token, options.Port)
+    }
+    for _, c := range []struct {
+        token string
+        source string
+    } {
+        {"token", "env STRUCTARG_TEST_TOKEN"},
+        {"cache-dir", "env STRUCTARG_TEST_HOME"},
+        {"port", "default"},
+    } {
+        src, _ := parser.Source(c.token)
+        if src.String() != c.source {
+            t.Errorf("Source %s = %s, expect %s", c.token, src, c.source)
+        }
+    }
+    if ! strings.Contains(parser.ConfigString(), "token = secret (env STRUCTARG_TEST_TOKEN)") {
+        t.Errorf("ConfigString = %s", parser.ConfigString())
+    }
+    path := writeTestFile(t, "test.conf", "path = ${STRUCTARG_TEST_HOME}/data\npattern = '${literal}'\n")
+    e = parser.ParseFile(path)
+    if e != nil || options.Path != "/home/test/data" || options.Pattern != "${literal}" {
+        t.Errorf("ParseFile = %q %q %v", options.Path, options.Pattern, e)
+    }
+    path = writeTestFile(t, "test.conf", "path = ${STRUCTARG_TEST_UNSET:?required}\n")
+    e = parser.ParseFile(path)
+    if e == nil || ! strings.HasSuffix(e.Error(), "test.conf:1: Cannot expand path: STRUCTARG_TEST_UNSET: required") {
+        t.Errorf("ParseFile error %v", e)
+    }
+
+    os.Unsetenv("STRUCTARG_TEST_TOKEN")
+    os.Setenv("STRUCTARG_TEST_PORT", "http")
+    defer os.Unsetenv("STRUCTARG_TEST_PORT")
+    options = &expandOptions{}
+    parser, _ = NewArgumentParser(options, "test", "test prog", "")
+    e = parser.ParseArgs([]string{"--token", "x"}, false)
+    if e == nil || ! strings.HasPrefix(e.Error(), "port error: Invalid default of --port") {
+        t.Errorf("ParseArgs error %v", e)
+    }
+    os.Unsetenv("STRUCTARG_TEST_PORT")
+    parser, _ = NewArgumentParser(&expandOptions{}, "test", "test prog", "")
+    e = parser.ParseArgs([]string{}, false)
+    if e == nil || e.Error() != "token error: Invalid default of --token: STRUCTARG_TEST_TOKEN: set STRUCTARG_TEST_TOKEN" {
+        t.Errorf("ParseArgs error %v", e)
+    }
+}
+
+type secretOptions struct {
+    Password string `help:"Password" secret:"true" env:"STRUCTARG_TEST_PASSWORD"`
+    Key string `help:"Key" secret:"true" choices:"k1|k2"`
+    Port int `help:"Port" secret:"true"`
+    User string `help:"User"`
+}
+
+func TestSecretArgument(t *testing.T) {
+    secret := writeTestFile(t, "secret", "s3cret\r\n\n")
+    cases := []struct {
+        args []string
+        env map[string]string
+        conf string
+        password string
+        source string
+    } {
+        {[]string{"--password", "plain"}, nil, "", "plain", "command line"},
+        {[]string{"--password", "@" + secret}, nil, "", "s3cret", "command line"},
+        {[]string{"--password", "@@" + secret}, nil, "", "@" + secret, "command line"},
+        {[]string{}, map[string]string{"STRUCTARG_TEST_PASSWORD_FILE": secret}, "", "s3cret", "env STRUCTARG_TEST_PASSWORD_FILE"},
+        {[]string{}, map[string]string{"STRUCTARG_TEST_PASSWORD": "env", "STRUCTARG_TEST_PASSWORD_FILE": secret}, "", "env", "env STRUCTARG_TEST_PASSWORD"},
+        {[]string{}, nil, "password = @" + secret + "\n", "s3cret", "file"},
+        {[]string{"--user", "@" + secret}, nil, "", "", "unset"},
+    }
+    for _, c := range cases {
+        for k, v := range c.env {
+            os.Setenv(k, v)
+        }
+        options := &secretOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        if len(c.conf) > 0 {
+            e = parser.ParseFile(writeTestFile(t, "test.conf", c.conf))
+        }
+        if e == nil {
+            e = parser.ParseArgs(c.args, false)
+        }
+        for k := range c.env {
+            os.Unsetenv(k)
+        }
+        if e != nil {
+            t.Errorf("ParseArgs %v error %s", c.args, e)
+            continue
+        }
+        src, _ := parser.Source("password")
+        if options.Password != c.password || ! strings.HasPrefix(src.String(), c.source) {
+            t.Errorf("ParseArgs %v = %q (%s)", c.args, options.Password, src)
+        }
+        if options.User != "" && options.User != "@" + secret {
+            t.Errorf("A non-secret value should not be read from a file: %q", options.User)
+        }
+    }
+}
+
+func TestSecretRedacted(t *testing.T) {
+    options := &secretOptions{}
+    parser, _ := NewArgumentParser(options, "test", "test prog", "")
+    e := parser.ParseArgs([]string{"--password", "s3cret", "--port", "8080", "--user", "admin"}, false)
+    if e != nil {
+        t.Fatalf("ParseArgs error %s", e)
+    }
+    config := parser.ConfigString()
+    if strings.Contains(config, "s3cret") || strings.Contains(config, "8080") || ! strings.Contains(config, "password = ****** (command line)") || ! strings.Contains(config, "user = admin (command line)") {
+        t.Errorf("ConfigString should redact secrets: %s", config)
+    }
+    if ! strings.Contains(parser.HelpString(), "[env: STRUCTARG_TEST_PASSWORD, STRUCTARG_TEST_PASSWORD_FILE]") {
+        t.Errorf("HelpString should show the file variable: %s", parser.HelpString())
+    }
+    cases := []struct {
+        args []string
+        err string
+    } {
+        {[]string{"--key", "s3cret"}, "Invalid secret value of key"},
+        {[]string{"--port", "s3cret"}, "Invalid secret value of port"},
+        {[]string{"--password", "@/nonexistent/s3cret"}, "Cannot read secret of password"},
+    }
+    for _, c := range cases {
+        parser, _ := NewArgumentParser(&secretOptions{}, "test", "test prog", "")
+        e := parser.ParseArgs(c.args, false)
+        if e == nil || ! strings.Contains(e.Error(), c.err) || strings.Contains(strings.Replace(e.Error(), "/nonexistent/s3cret", "", -1), "s3cret") {
+            t.Errorf("ParseArgs %v error %v, expect %s", c.args, e, c.err)
+        }
+    }
+}
+
+func TestSecretRedactedErrors(t *testing.T) {
+    os.Setenv("STRUCTARG_TEST_SECRET_PORT", "s3cret")
+    defer os.Unsetenv("STRUCTARG_TEST_SECRET_PORT")
+    options := &struct {
+        Port int `secret:"true" default:"$STRUCTARG_TEST_SECRET_PORT"`
+        Password string `secret:"true"`
+    }{}
+    parser, e := NewArgumentParser(options, "test", "test prog", "")
+    if e != nil {
+        t.Fatalf("NewArgumentParser error %s", e)
+    }
+    e = parser.ParseArgs([]string{}, false)
+    if e == nil || e.Error() != "port error: Invalid default of --port" {
+        t.Errorf("ParseArgs error %v", e)
+    }
+    path := writeTestFile(t, "test.conf", "password = s3cret${x\n")
+    e = parser.ParseFile(path)
+    if e == nil || e.Error() != path + ":1: Cannot expand password" {
+        t.Errorf("ParseFile error %v", e)
+    }
+}
+
+type envFileOptions struct {
+    EnvFile string `help:"Env file" env-file:"true"`
+    Timeout int `help:"Timeout" default:"600"`
+    AuthURL string `help:"Auth URL" default:"$STRUCTARG_TEST_AUTH_URL|http://default"`
+    Region string `help:"Region" env:"STRUCTARG_TEST_REGION"`
+    SUBCOMMAND string `help:"Subcommand" subcommand:"true"`
+}
+
+func TestLoadEnvFile(t *testing.T) {
+    path := writeTestFile(t, "test.env", "export STRUCTARG_TEST_TIMEOUT=10\n" +
+            "STRUCTARG_TEST_AUTH_URL=\"http://auth\"\n" +
+            "STRUCTARG_TEST_REGION=east\n" +
+            "STRUCTARG_TEST_ARG1=env\n")
+    cases := []struct {
+        args []string
+        load bool
+        region string
+        timeout int
+        authURL string
+        arg1 string
+    } {
+        {[]string{"test", "name"}, true, "west", 10, "http://auth", "env"},
+        {[]string{"--env-file", path, "test", "name"}, false, "west", 10, "http://auth", "env"},
+        {[]string{"--env-file", path, "--timeout", "5", "test", "--arg1", "cli", "name"}, false, "west", 5, "http://auth", "cli"},
+        {[]string{"test", "name"}, false, "west", 600, "http://default", ""},
+    }
+    os.Setenv("STRUCTARG_TEST_REGION", "west")
+    defer os.Unsetenv("STRUCTARG_TEST_REGION")
+    for _, c := range cases {
+        options := &envFileOptions{}
+        parser, e := NewArgumentParser(options, "test", "test prog", "")
+        if e != nil {
+            t.Fatalf("NewArgumentParser error %s", e)
+        }
+        parser.SetEnvPrefix("STRUCTARG_TEST_")
+        if c.load {
+            e = parser.LoadEnvFile(path)
+            if e != nil {
+                t.Fatalf("LoadEnvFile error %s", e)
+            }
+        }
+        suboptions := &subcommandTestOptions{}
+        parser.GetSubcommand().AddSubParser(suboptions, "test", "Run a test", func(opts *subcommandTestOptions) error {
+            return nil
+        })
+        e = parser.ParseArgs(c.args, false)
+        if e != nil {
+            t.Errorf("ParseArgs %v error %s", c.args, e)
+            continue
+        }
+        if options.Region != c.region || options.Timeout != c.timeout || options.AuthURL != c.authURL || suboptions.Arg1 != c.arg1 {
+            t.Errorf("ParseArgs %v = %q %d %q %q", c.args, options.Region, options.Timeout, options.AuthURL, suboptions.Arg1)
+        }
+    }
+    if _, found := os.LookupEnv("STRUCTARG_TEST_TIMEOUT"); found {
+        t.Errorf("LoadEnvFile should not change the process environment")
+    }
+    parser, _ := NewArgumentParser(&envFileOptions{}, "test", "test prog", "")
+    e := parser.ParseArgs([]string{"--env-file", filepath.Join(t.TempDir(), "missing.env")}, false)
+    if e == nil {
+        t.Errorf("A missing env file should be an error")
+    }
+    _, e = NewArgumentParser(&struct {
+        EnvFile int `env-file:"true"`
+    }{}, "test", "test prog", "")
+    if e == nil || e.Error() != "Env file argument EnvFile must be an optional string" {
+        t.Errorf("Env file argument error %v", e)
+    }
+}
+
+func TestSourceSetter(t *testing.T) {
+    for _, arg := range []Argument{&SingleArgument{}, &MultiArgument{}, &MapArgument{}, &SubcommandArgument{}} {
+        if _, ok := arg.(sourceSetter); ! ok {
+            t.Errorf("%T should record its source", arg)
+        }
+    }
+}